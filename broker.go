@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+var tIndex topicNames
+var clients Clients
+var subscriptions *subscriptionTree
+var retained retainedMessages
+var sessions Sessions
+var wills pendingWills
+var store Storage
+
+// InitBroker sets up the state shared by all listeners, restoring whatever
+// was kept by the storage, and starts the background workers.
+func InitBroker(storage Storage) error {
+	store = storage
+	tIndex = topicNames{
+		contents:   make(map[uint16]string),
+		ids:        make(map[string]uint16),
+		predefined: make(map[uint16]bool),
+		recent:     make(map[uint16]bool),
+	}
+	if err := loadPredefinedTopics(&tIndex, serv.Config.PredefinedTopics); err != nil {
+		return err
+	}
+	clients = Clients{
+		clients: make(map[string]*Client),
+		ids:     make(map[string]*Client),
+	}
+	subscriptions = newSubscriptionTree()
+	retained = retainedMessages{
+		root: newRetainedNode(),
+	}
+	sessions = Sessions{
+		sessions: make(map[string]*Client),
+		stored:   make(map[string]bool),
+	}
+	wills = pendingWills{
+		wills: make(map[string]*delayedWill),
+	}
+
+	state, err := store.Load()
+	if err != nil {
+		return err
+	}
+	for id, topic := range state.Topics {
+		tIndex.restore(id, topic)
+	}
+	for topic, msg := range state.Retained {
+		retained.restore(topic, NewPublishMessage(0, 0x00, msg.Data, msg.Qos, 0, true, false))
+	}
+	for id, session := range state.Sessions {
+		sessions.sessions[id] = restoreClient(session)
+		sessions.stored[id] = true
+	}
+	log.Println("Restored", len(state.Topics), "topics,", len(state.Retained),
+		"retained messages and", len(state.Sessions), "sessions")
+
+	go Supervise(time.Second)
+	go Retransmit(time.Second)
+	go Checkpoint(time.Second)
+	return nil
+}
+
+// ShutdownBroker saves persistent sessions of connected clients and saved
+// sessions, disconnects MQTT clients and closes the storage.
+func ShutdownBroker() {
+	sessions.Close()
+	for _, client := range clients.List() {
+		if client.Stream() == nil {
+			continue
+		}
+		// Removed first, so that the connection is not taken for lost and
+		// the will is not published.
+		clients.RemoveClient(client)
+		client.Disconnect(MQTT_SERVER_SHUTTING_DOWN)
+	}
+	if err := store.Close(); err != nil {
+		log.Println(err)
+	}
+}
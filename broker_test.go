@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBrokerAddr is the MQTT-SN socket of the broker shared by all tests.
+// Tests use their own client ids and topics, as the broker state is global.
+var testBrokerAddr *net.UDPAddr
+
+// perClientIdsEnv makes the tests run with per-client topic IDs. The option is
+// read by the broker all the time, so tests of it run in a broker of their
+// own.
+const perClientIdsEnv = "GOMQTT_PER_CLIENT_IDS"
+
+// storagePathEnv makes the tests run with a FileStorage at the given path
+// instead of testStorage.
+const storagePathEnv = "GOMQTT_STORAGE"
+
+// testStorage records the sessions the broker stores.
+var testStorage = &memStorage{sessions: make(map[string]*StoredSession)}
+
+type memStorage struct {
+	nopStorage
+	sync.Mutex
+	sessions map[string]*StoredSession
+}
+
+func (s *memStorage) PutSession(session *StoredSession) error {
+	defer s.Unlock()
+	s.Lock()
+	s.sessions[session.ClientId] = session
+	return nil
+}
+
+func (s *memStorage) DeleteSession(clientId string) error {
+	defer s.Unlock()
+	s.Lock()
+	delete(s.sessions, clientId)
+	return nil
+}
+
+// waitSession waits for the stored session of a client to satisfy ok, which
+// is given nil if there is none.
+func (s *memStorage) waitSession(t testing.TB, clientId string, ok func(*StoredSession) bool) {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); {
+		s.Lock()
+		session := s.sessions[clientId]
+		s.Unlock()
+		if ok(session) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("stored session of", clientId, "does not match")
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	debug = false
+	serv.Config.Buffer = 512
+	serv.Config.MaxPacketSize = 4096
+	serv.Config.Session.IdleTimeout = 3600
+	serv.Config.QoS.RetryInterval = 1
+	serv.Config.QoS.MaxRetries = 2
+	serv.Config.QoS.MaxInflight = 2
+	serv.Config.QoS.Connectionless = true
+	serv.Config.PredefinedTopics = map[string]string{"100": "/predefined"}
+	serv.Config.TLS.Identity = "CN"
+	if os.Getenv(perClientIdsEnv) != "" {
+		serv.Config.Topics.PerClientIds = true
+	}
+	var storage Storage = testStorage
+	if path := os.Getenv(storagePathEnv); path != "" {
+		var err error
+		if storage, err = OpenFileStorage(path); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := InitBroker(storage); err != nil {
+		log.Fatalln(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	testBrokerAddr = conn.LocalAddr().(*net.UDPAddr)
+	go ServeUDP(conn)
+	os.Exit(m.Run())
+}
+
+// snClient is an MQTT-SN client talking to the test broker.
+type snClient struct {
+	t    testing.TB
+	conn *net.UDPConn
+}
+
+func dialSN(t testing.TB) *snClient {
+	conn, err := net.DialUDP("udp", nil, testBrokerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &snClient{t, conn}
+}
+
+func (c *snClient) send(m Message) {
+	c.t.Helper()
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+	// Packets are handled concurrently, so give the broker time to keep
+	// them in order.
+	time.Sleep(20 * time.Millisecond)
+}
+
+// read returns the next packet other than ADVERTISE, or nil after d.
+func (c *snClient) read(d time.Duration) Message {
+	c.t.Helper()
+	buf := make([]byte, 1024)
+	c.conn.SetReadDeadline(time.Now().Add(d))
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return nil
+		}
+		m, err := ReadPacket(bytes.NewBuffer(buf[:n]))
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if _, ok := m.(*AdvertiseMessage); !ok {
+			return m
+		}
+	}
+}
+
+func (c *snClient) recv() Message {
+	c.t.Helper()
+	m := c.read(2 * time.Second)
+	if m == nil {
+		c.t.Fatal("no packet received")
+	}
+	return m
+}
+
+func (c *snClient) expectNone() {
+	c.t.Helper()
+	if m := c.read(300 * time.Millisecond); m != nil {
+		c.t.Fatalf("unexpected %#v", m)
+	}
+}
+
+func (c *snClient) connect(id string, clean bool) {
+	c.t.Helper()
+	m := NewMessage(CONNECT).(*ConnectMessage)
+	m.ClientId = []byte(id)
+	m.CleanSession = clean
+	c.send(m)
+	if ack, ok := c.recv().(*ConnackMessage); !ok || ack.ReturnCode != ACCEPTED {
+		c.t.Fatalf("connection of %s refused", id)
+	}
+}
+
+func (c *snClient) subscribe(filter string, qos byte) *SubackMessage {
+	c.t.Helper()
+	return c.subscribeTo(0x00, filter, qos)
+}
+
+// subscribeTo subscribes to a topic name or filter of the given type. Short
+// topic names are given as the name, predefined topic IDs in decimal.
+func (c *snClient) subscribeTo(topicIdType byte, topic string, qos byte) *SubackMessage {
+	c.t.Helper()
+	m := NewMessage(SUBSCRIBE).(*SubscribeMessage)
+	m.TopicIdType = topicIdType
+	if topicIdType == 0x01 {
+		id, _ := strconv.Atoi(topic)
+		m.TopicId = uint16(id)
+	} else {
+		m.TopicName = []byte(topic)
+	}
+	m.Qos = qos
+	m.MessageId = 1
+	c.send(m)
+	ack, ok := c.recv().(*SubackMessage)
+	if !ok {
+		c.t.Fatal("expected SUBACK")
+	}
+	return ack
+}
+
+// unsubscribe removes a subscription given as to subscribeTo.
+func (c *snClient) unsubscribe(topicIdType byte, topic string) {
+	c.t.Helper()
+	m := NewMessage(UNSUBSCRIBE).(*UnsubscribeMessage)
+	m.TopicIdType = topicIdType
+	if topicIdType == 0x01 {
+		id, _ := strconv.Atoi(topic)
+		m.TopicId = uint16(id)
+	} else {
+		m.TopicName = []byte(topic)
+	}
+	m.MessageId = 3
+	c.send(m)
+	if ack, ok := c.recv().(*UnsubackMessage); !ok || ack.MessageId != 3 {
+		c.t.Fatalf("expected UNSUBACK, got %#v", ack)
+	}
+}
+
+func (c *snClient) register(topic string) uint16 {
+	c.t.Helper()
+	c.send(NewRegisterMessage(0, 2, []byte(topic)))
+	ack, ok := c.recv().(*RegackMessage)
+	if !ok || ack.ReturnCode != ACCEPTED {
+		c.t.Fatal("registration of", topic, "failed")
+	}
+	return ack.TopicId
+}
+
+// publish sends a message on a registered topic ID. QoS 1 and 2 messages
+// use message ID 1.
+func (c *snClient) publish(topicId uint16, qos byte, data string) {
+	c.t.Helper()
+	var id uint16
+	if qos > 0 {
+		id = 1
+	}
+	c.send(NewPublishMessage(topicId, 0x00, []byte(data), qos, id, false, false))
+}
+
+// receivePublish returns the next PUBLISH, answering REGISTER on the way.
+func (c *snClient) receivePublish() *PublishMessage {
+	c.t.Helper()
+	for {
+		switch m := c.recv().(type) {
+		case *RegisterMessage:
+			ack := NewMessage(REGACK).(*RegackMessage)
+			ack.TopicId = m.TopicId
+			ack.MessageId = m.MessageId
+			ack.ReturnCode = ACCEPTED
+			c.send(ack)
+		case *PublishMessage:
+			return m
+		default:
+			c.t.Fatalf("expected PUBLISH, got %#v", m)
+		}
+	}
+}
@@ -4,25 +4,79 @@ import (
 	"bytes"
 	"net"
 	"sync"
+	"time"
 )
 
+// Client connection states. A client that asked for a will stays in one of
+// the will states until the handshake is complete and CONNACK is sent. The
+// rest follow the client state machine of MQTT-SN:
+// - active clients receive messages right away;
+// - asleep clients get their messages buffered;
+// - awake clients receive buffered messages before going asleep again;
+// - lost clients missed their keep-alive or sleep duration;
+// - disconnected clients left cleanly.
+// Lost and disconnected clients with a persistent session get messages with
+// QoS > 0 buffered as well.
+const (
+	stateWillTopic = iota
+	stateWillMsg
+	stateActive
+	stateAsleep
+	stateAwake
+	stateLost
+	stateDisconnected
+)
+
+// Will is a message published by the broker on behalf of a client that
+// disappeared without sending DISCONNECT.
+type Will struct {
+	Topic      string
+	Qos        byte
+	Retain     bool
+	Msg        []byte
+	Properties *mqttProperties
+}
+
 type Client struct {
 	sync.RWMutex
 	ClientId         string
 	Conn             *net.UDPConn
 	Address          *net.UDPAddr
+	stream           *mqttConn // set instead of Conn for clients using MQTT
 	registeredTopics map[uint16]string
-	pendingMessages  map[uint16]*PublishMessage
+	registeredIds    map[string]uint16
+	nextTopicId      uint16
+	subscriptions    map[string]byte
+	inflight         map[uint16]*inflightMessage
+	received         map[uint16]bool
+	nextMessageId    uint16
+	state            int
+	will             *Will
+	keepAlive        time.Duration
+	sleep            time.Duration
+	lastSeen         time.Time
+	queue            messageQueue
+	registrations    map[uint16]*registration
+	cleanSession     bool
+	sessionExpiry    time.Duration
+	dirty            bool // the session changed since it was last stored
+	certified        bool // the client id was taken from a client certificate
 }
 
 func NewClient(ClientId string, Conn *net.UDPConn, Address *net.UDPAddr) *Client {
 	return &Client{
-		sync.RWMutex{},
-		ClientId,
-		Conn,
-		Address,
-		make(map[uint16]string),
-		make(map[uint16]*PublishMessage),
+		ClientId:         ClientId,
+		Conn:             Conn,
+		Address:          Address,
+		registeredTopics: make(map[uint16]string),
+		registeredIds:    make(map[string]uint16),
+		subscriptions:    make(map[string]byte),
+		inflight:         make(map[uint16]*inflightMessage),
+		received:         make(map[uint16]bool),
+		registrations:    make(map[uint16]*registration),
+		state:            stateActive,
+		cleanSession:     true,
+		lastSeen:         time.Now(),
 	}
 }
 
@@ -32,38 +86,344 @@ func (c *Client) Write(m Message) (err error) {
 	if err != nil {
 		return
 	}
-	_, err = c.Conn.WriteToUDP(buf.Bytes(), c.Address)
+	c.RLock()
+	conn, addr := c.Conn, c.Address
+	c.RUnlock()
+	_, err = conn.WriteToUDP(buf.Bytes(), addr)
 	return
 }
 
+// Rebind makes the client use another connection and address, as it may
+// connect from anywhere when resuming its session. It returns the MQTT
+// connection the client used instead, if any, for the caller to close.
+func (c *Client) Rebind(conn *net.UDPConn, addr *net.UDPAddr) *mqttConn {
+	defer c.Unlock()
+	c.Lock()
+	stream := c.stream
+	c.stream = nil
+	c.Conn = conn
+	c.Address = addr
+	return stream
+}
+
+// Attach makes the client use an MQTT connection instead of MQTT-SN.
+func (c *Client) Attach(stream *mqttConn) {
+	defer c.Unlock()
+	c.Lock()
+	c.Conn = nil
+	c.Address = nil
+	c.stream = stream
+}
+
+// Stream returns the MQTT connection of the client, or nil if the client
+// uses MQTT-SN.
+func (c *Client) Stream() *mqttConn {
+	defer c.RUnlock()
+	c.RLock()
+	return c.stream
+}
+
+// Disconnect closes the MQTT connection of the client, if there is one,
+// telling MQTT 5.0 clients the reason.
+func (c *Client) Disconnect(reason byte) {
+	defer c.RUnlock()
+	c.RLock()
+	if c.stream != nil {
+		c.stream.disconnect(reason)
+	}
+}
+
 func (c *Client) Register(topicId uint16, topic string) {
 	defer c.Unlock()
 	c.Lock()
 	c.registeredTopics[topicId] = topic
+	c.registeredIds[topic] = topicId
+	c.dirty = true
+}
+
+// RegisterTopic registers a topic with the client under an ID from its own
+// topic ID space and returns the ID, or 0 if the space is full.
+func (c *Client) RegisterTopic(topic string) uint16 {
+	defer c.Unlock()
+	c.Lock()
+	if topicId, ok := c.registeredIds[topic]; ok {
+		return topicId
+	}
+	topicId := c.allocateTopicId()
+	if topicId != 0 {
+		c.registeredTopics[topicId] = topic
+		c.registeredIds[topic] = topicId
+		c.dirty = true
+	}
+	return topicId
+}
+
+// allocateTopicId returns the next topic ID that is neither registered with
+// the client nor being registered nor predefined, or 0 if there is none. The
+// IDs 0x0000 and 0xFFFF are reserved. The caller must hold the lock.
+func (c *Client) allocateTopicId() uint16 {
+	pending := make(map[uint16]bool, len(c.registrations))
+	for _, r := range c.registrations {
+		pending[r.topicId] = true
+	}
+	for i := 0; i <= 0xFFFF; i++ {
+		c.nextTopicId++
+		if c.nextTopicId == 0x0000 || c.nextTopicId == 0xFFFF || pending[c.nextTopicId] {
+			continue
+		}
+		if tIndex.isPredefined(c.nextTopicId) {
+			continue
+		}
+		if _, ok := c.registeredTopics[c.nextTopicId]; !ok {
+			return c.nextTopicId
+		}
+	}
+	return 0
+}
+
+// RegisteredTopic returns the topic registered with the client under an ID.
+func (c *Client) RegisteredTopic(topicId uint16) (string, bool) {
+	defer c.RUnlock()
+	c.RLock()
+	topic, ok := c.registeredTopics[topicId]
+	return topic, ok
+}
+
+// RegisteredId returns the ID a topic is registered with the client under, or
+// 0 if it is not registered.
+func (c *Client) RegisteredId(topic string) uint16 {
+	defer c.RUnlock()
+	c.RLock()
+	return c.registeredIds[topic]
 }
 
-func (c *Client) Registered(topicId uint16) bool {
+// TopicIds returns the normal topic IDs the client knows or is about to know:
+// the registered ones, the ones being registered and the ones used by
+// messages in flight.
+func (c *Client) TopicIds() []uint16 {
 	defer c.RUnlock()
 	c.RLock()
-	_, ok := c.registeredTopics[topicId]
+	ids := make([]uint16, 0, len(c.registeredTopics)+len(c.registrations))
+	for id := range c.registeredTopics {
+		ids = append(ids, id)
+	}
+	for _, r := range c.registrations {
+		ids = append(ids, r.topicId)
+	}
+	for _, m := range c.inflight {
+		if m.msg.TopicIdType == 0x00 {
+			ids = append(ids, m.msg.TopicId)
+		}
+	}
+	return ids
+}
+
+// Subscribe records the options, most importantly the QoS level, the client
+// subscribed to a topic filter with. It returns false if the client was not
+// subscribed to the filter before.
+func (c *Client) Subscribe(filter string, options byte) bool {
+	defer c.Unlock()
+	c.Lock()
+	_, existed := c.subscriptions[filter]
+	c.subscriptions[filter] = options
+	subscriptions.subscribe(filter, c, options)
+	c.dirty = true
+	return existed
+}
+
+// Unsubscribe removes the client's subscription to a topic filter. It
+// returns false if there was no such subscription.
+func (c *Client) Unsubscribe(filter string) bool {
+	defer c.Unlock()
+	c.Lock()
+	_, ok := c.subscriptions[filter]
+	if ok {
+		delete(c.subscriptions, filter)
+		subscriptions.unsubscribe(filter, c)
+		c.dirty = true
+	}
 	return ok
 }
 
-func (c *Client) AddPendingMessage(p *PublishMessage) {
+func (c *Client) State() int {
+	defer c.RUnlock()
+	c.RLock()
+	return c.state
+}
+
+func (c *Client) SetState(state int) {
+	defer c.Unlock()
+	c.Lock()
+	c.state = state
+}
+
+// SetWillTopic sets the topic of the client's will, keeping the payload of
+// the existing will, if any. An empty topic deletes the will.
+func (c *Client) SetWillTopic(topic string, qos byte, retain bool) {
+	defer c.Unlock()
+	c.Lock()
+	if topic == "" {
+		c.will = nil
+		return
+	}
+	will := &Will{Topic: topic, Qos: qos, Retain: retain}
+	if c.will != nil {
+		will.Msg = c.will.Msg
+	}
+	c.will = will
+}
+
+// SetWillMsg sets the payload of the will started by SetWillTopic. It returns
+// false if the client has no will topic.
+func (c *Client) SetWillMsg(msg []byte) bool {
+	defer c.Unlock()
+	c.Lock()
+	if c.will == nil {
+		return false
+	}
+	c.will.Msg = msg
+	return true
+}
+
+func (c *Client) Will() *Will {
+	defer c.RUnlock()
+	c.RLock()
+	return c.will
+}
+
+// SetWill replaces the will of the client. Nil deletes it.
+func (c *Client) SetWill(will *Will) {
 	defer c.Unlock()
 	c.Lock()
-	c.pendingMessages[p.TopicId] = p
+	c.will = will
 }
 
-func (c *Client) FetchPendingMessage(topicId uint16) *PublishMessage {
+func (c *Client) SetCleanSession(clean bool) {
 	defer c.Unlock()
 	c.Lock()
-	pm := c.pendingMessages[topicId]
-	delete(c.pendingMessages, topicId)
-	return pm
+	c.cleanSession = clean
+	c.sessionExpiry = 0
+	c.dirty = true
+}
+
+// CleanSession reports whether the state of the client must be dropped once
+// it disconnects.
+func (c *Client) CleanSession() bool {
+	defer c.RUnlock()
+	c.RLock()
+	return c.cleanSession
+}
+
+// SetSessionExpiry sets how long the session of an MQTT 5.0 client outlives
+// its connection. It must be called after SetCleanSession. Zero keeps the
+// session until the client cleans it.
+func (c *Client) SetSessionExpiry(expiry time.Duration) {
+	defer c.Unlock()
+	c.Lock()
+	c.sessionExpiry = expiry
+	c.dirty = true
+}
+
+func (c *Client) SessionExpiry() time.Duration {
+	defer c.RUnlock()
+	c.RLock()
+	return c.sessionExpiry
+}
+
+// SetCertified records whether the client id was taken from a client
+// certificate.
+func (c *Client) SetCertified(certified bool) {
+	defer c.Unlock()
+	c.Lock()
+	c.dirty = c.dirty || c.certified != certified
+	c.certified = certified
+}
+
+func (c *Client) Certified() bool {
+	defer c.RUnlock()
+	c.RLock()
+	return c.certified
+}
+
+// Dirty reports whether the session changed since Snapshot was last called.
+func (c *Client) Dirty() bool {
+	defer c.RUnlock()
+	c.RLock()
+	return c.dirty
+}
+
+// SetKeepAlive sets the keep-alive duration in seconds as requested by the
+// client on CONNECT. Zero disables keep-alive supervision.
+func (c *Client) SetKeepAlive(duration uint16) {
+	defer c.Unlock()
+	c.Lock()
+	c.keepAlive = time.Duration(duration) * time.Second
+}
+
+// Touch records that the client was heard from.
+func (c *Client) Touch() {
+	defer c.Unlock()
+	c.Lock()
+	c.lastSeen = time.Now()
+}
+
+// Activity returns the time the client was last heard from and the period
+// within which it promised to talk to the broker again: its sleep duration
+// if it is asleep or its keep-alive duration otherwise.
+func (c *Client) Activity() (time.Time, time.Duration) {
+	defer c.RUnlock()
+	c.RLock()
+	if c.state == stateAsleep {
+		return c.lastSeen, c.sleep
+	}
+	return c.lastSeen, c.keepAlive
+}
+
+// Sleep puts the client asleep for the given duration in seconds.
+func (c *Client) Sleep(duration uint16) {
+	defer c.Unlock()
+	c.Lock()
+	c.state = stateAsleep
+	c.sleep = time.Duration(duration) * time.Second
+}
+
+// Sleeping reports whether the client is asleep or awake for a moment.
+func (c *Client) Sleeping() bool {
+	defer c.RUnlock()
+	c.RLock()
+	return c.state == stateAsleep || c.state == stateAwake
+}
+
+// Free drops everything the broker keeps on behalf of the client except for
+// its will.
+func (c *Client) Free() {
+	defer c.Unlock()
+	c.Lock()
+	for filter := range c.subscriptions {
+		subscriptions.unsubscribe(filter, c)
+	}
+	c.registeredTopics = make(map[uint16]string)
+	c.registeredIds = make(map[string]uint16)
+	c.subscriptions = make(map[string]byte)
+	c.inflight = make(map[uint16]*inflightMessage)
+	c.received = make(map[uint16]bool)
+	c.registrations = make(map[uint16]*registration)
+	c.queue = messageQueue{}
+	c.dirty = true
 }
 
 func (c *Client) AddrString() string {
+	defer c.RUnlock()
+	c.RLock()
+	if c.stream != nil {
+		addr := c.stream.RemoteAddr()
+		return addr.Network() + "://" + addr.String()
+	}
+	// Sessions restored from the storage have no address until they are
+	// resumed.
+	if c.Address == nil {
+		return ""
+	}
 	return c.Address.String()
 }
 
@@ -75,6 +435,8 @@ type Clients struct {
 	sync.RWMutex
 	// indexed by "address:port" => StorableClient
 	clients map[string]*Client
+	// indexed by client id
+	ids map[string]*Client
 }
 
 func (c *Clients) GetClient(addr *net.UDPAddr) *Client {
@@ -83,6 +445,14 @@ func (c *Clients) GetClient(addr *net.UDPAddr) *Client {
 	return c.clients[addr.String()]
 }
 
+// GetClientById returns the connected client with the given id, or nil if
+// there is none.
+func (c *Clients) GetClientById(clientId string) *Client {
+	defer c.RUnlock()
+	c.RLock()
+	return c.ids[clientId]
+}
+
 // AddClient returns true if this is a new client, false otherwise
 // Clients are indexed by their address:port b/c
 // that's the only identifying information we have
@@ -95,14 +465,69 @@ func (c *Clients) AddClient(client *Client) bool {
 	if c.clients[addr] == nil {
 		isNew = true
 	}
-	//todo: what to do if clientid is in use?
-	//     is there some cleanup involved in topictree?
 	c.clients[addr] = client
+	c.ids[client.ClientId] = client
 	return isNew
 }
 
-func (c *Clients) RemoveClient(id string) {
+// Takeover moves the client with the given id to a new address, as NAT
+// rebinding and cellular modems change source ports all the time. It returns
+// the client, or nil if there is no such client, and its previous address if
+// it has changed. An MQTT connection of the client is closed.
+func (c *Clients) Takeover(clientId string, conn *net.UDPConn, addr *net.UDPAddr) (*Client, *net.UDPAddr) {
+	client, oldAddr, stream := c.move(clientId, conn, addr)
+	// Closing may take a while, so it is done without holding the lock.
+	if stream != nil {
+		stream.disconnect(MQTT_SESSION_TAKEN_OVER)
+	}
+	return client, oldAddr
+}
+
+// move indexes the client with the given id under its new address and
+// returns the client, its previous address and the MQTT connection it used.
+func (c *Clients) move(clientId string, conn *net.UDPConn, addr *net.UDPAddr) (*Client, *net.UDPAddr, *mqttConn) {
 	defer c.Unlock()
 	c.Lock()
-	delete(c.clients, id)
+	client := c.ids[clientId]
+	if client == nil {
+		return nil, nil, nil
+	}
+	old := client.AddrString()
+	if old == addr.String() {
+		return client, nil, nil
+	}
+	client.RLock()
+	oldAddr := client.Address
+	client.RUnlock()
+	if c.clients[old] == client {
+		delete(c.clients, old)
+	}
+	stream := client.Rebind(conn, addr)
+	c.clients[addr.String()] = client
+	return client, oldAddr, stream
+}
+
+// RemoveClient forgets the client, unless it was replaced by another one
+// meanwhile.
+func (c *Clients) RemoveClient(client *Client) {
+	defer c.Unlock()
+	c.Lock()
+	addr := client.AddrString()
+	if c.clients[addr] == client {
+		delete(c.clients, addr)
+	}
+	if c.ids[client.ClientId] == client {
+		delete(c.ids, client.ClientId)
+	}
+}
+
+// List returns a snapshot of all known clients.
+func (c *Clients) List() []*Client {
+	defer c.RUnlock()
+	c.RLock()
+	list := make([]*Client, 0, len(c.clients))
+	for _, client := range c.clients {
+		list = append(list, client)
+	}
+	return list
 }
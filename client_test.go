@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+func TestAllocateTopicIdSkipsPredefined(t *testing.T) {
+	c := NewClient("skip-predefined", nil, nil)
+	for i := 0; i < 200; i++ {
+		if id := c.RegisterTopic("/skip/" + strconv.Itoa(i)); id == 100 || id == 0 {
+			t.Fatal("bad topic ID", id)
+		}
+	}
+}
+
+func TestPerClientTopicIds(t *testing.T) {
+	if !serv.Config.Topics.PerClientIds {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestPerClientTopicIds$")
+		cmd.Env = append(os.Environ(), perClientIdsEnv+"=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		return
+	}
+
+	a := dialSN(t)
+	a.connect("perclient-a", true)
+	a.register("/perclient/only-a")
+	idA := a.register("/perclient/shared")
+	b := dialSN(t)
+	b.connect("perclient-b", true)
+	idB := b.register("/perclient/shared")
+	if idA == idB {
+		t.Fatal("both clients got topic ID", idA)
+	}
+	if b.subscribe("/perclient/shared", 0).TopicId != idB {
+		t.Fatal("SUBACK does not carry the topic ID of the client")
+	}
+
+	// A subscriber that did not register the topic gets it registered under
+	// an ID of its own.
+	c := dialSN(t)
+	c.connect("perclient-c", true)
+	c.subscribe("/perclient/#", 0)
+	a.publish(idA, 0, "shared")
+	if p := b.receivePublish(); p.TopicId != idB || string(p.Data) != "shared" {
+		t.Fatalf("b got %#v", p)
+	}
+	reg, ok := c.recv().(*RegisterMessage)
+	if !ok || string(reg.TopicName) != "/perclient/shared" {
+		t.Fatalf("expected REGISTER of /perclient/shared, got %#v", reg)
+	}
+	ack := NewMessage(REGACK).(*RegackMessage)
+	ack.TopicId = reg.TopicId
+	ack.MessageId = reg.MessageId
+	ack.ReturnCode = ACCEPTED
+	c.send(ack)
+	if p := c.receivePublish(); p.TopicId != reg.TopicId {
+		t.Fatalf("c got topic ID %d instead of %d", p.TopicId, reg.TopicId)
+	}
+
+	// The IDs of a clean session are gone once it ends.
+	a.connect("perclient-a", true)
+	a.send(NewPublishMessage(idA, 0x00, []byte("stale"), 1, 1, false, false))
+	if ack, ok := a.recv().(*PubackMessage); !ok || ack.ReturnCode != REJ_INVALID_TID {
+		t.Fatal("topic ID kept after the session ended")
+	}
+	b.expectNone()
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Operations recorded in the log of FileStorage.
+const (
+	opTopic          = "topic"
+	opDeleteTopic    = "untopic"
+	opRetain         = "retain"
+	opDeleteRetained = "unretain"
+	opSession        = "session"
+	opDeleteSession  = "unsession"
+)
+
+// compactionThreshold is the number of records in the log that are allowed
+// on top of the live ones before the log is compacted.
+const compactionThreshold = 1024
+
+type logRecord struct {
+	Op       string
+	TopicId  uint16         `json:",omitempty"`
+	Topic    string         `json:",omitempty"`
+	ClientId string         `json:",omitempty"`
+	Message  *StoredMessage `json:",omitempty"`
+	Session  *StoredSession `json:",omitempty"`
+}
+
+// FileStorage is a Storage backed by an append-only log of JSON records in a
+// single file. The log is compacted on open and whenever it grows much
+// larger than the state it describes.
+type FileStorage struct {
+	sync.Mutex
+	path    string
+	file    *os.File
+	state   StoredState
+	records int
+}
+
+func OpenFileStorage(path string) (*FileStorage, error) {
+	s := &FileStorage{
+		path: path,
+		state: StoredState{
+			Topics:   make(map[uint16]string),
+			Retained: make(map[string]StoredMessage),
+			Sessions: make(map[string]*StoredSession),
+		},
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay reads the log into memory.
+func (s *FileStorage) replay() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var r logRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// The last record may be cut short by a crash.
+			break
+		}
+		s.apply(&r)
+	}
+	return scanner.Err()
+}
+
+func (s *FileStorage) apply(r *logRecord) {
+	switch r.Op {
+	case opTopic:
+		s.state.Topics[r.TopicId] = r.Topic
+	case opDeleteTopic:
+		delete(s.state.Topics, r.TopicId)
+	case opRetain:
+		if r.Message != nil {
+			s.state.Retained[r.Topic] = *r.Message
+		}
+	case opDeleteRetained:
+		delete(s.state.Retained, r.Topic)
+	case opSession:
+		if r.Session != nil {
+			s.state.Sessions[r.Session.ClientId] = r.Session
+		}
+	case opDeleteSession:
+		delete(s.state.Sessions, r.ClientId)
+	}
+}
+
+// compact rewrites the log with the live state only and reopens it for
+// appending. The caller must hold the lock, unless the storage is being
+// opened.
+func (s *FileStorage) compact() error {
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	records := 0
+	for id, topic := range s.state.Topics {
+		if err = enc.Encode(logRecord{Op: opTopic, TopicId: id, Topic: topic}); err != nil {
+			break
+		}
+		records++
+	}
+	for topic, msg := range s.state.Retained {
+		if err != nil {
+			break
+		}
+		m := msg
+		err = enc.Encode(logRecord{Op: opRetain, Topic: topic, Message: &m})
+		records++
+	}
+	for _, session := range s.state.Sessions {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(logRecord{Op: opSession, Session: session})
+		records++
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	s.records = records
+	return err
+}
+
+// append writes a record to the log and applies it to the state.
+func (s *FileStorage) append(r logRecord) error {
+	defer s.Unlock()
+	s.Lock()
+	s.apply(&r)
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err = s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.records++
+	live := len(s.state.Topics) + len(s.state.Retained) + len(s.state.Sessions)
+	if s.records > 2*live+compactionThreshold {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *FileStorage) PutTopic(id uint16, topic string) error {
+	return s.append(logRecord{Op: opTopic, TopicId: id, Topic: topic})
+}
+
+func (s *FileStorage) DeleteTopic(id uint16) error {
+	return s.append(logRecord{Op: opDeleteTopic, TopicId: id})
+}
+
+func (s *FileStorage) PutRetained(topic string, msg *PublishMessage) error {
+	return s.append(logRecord{Op: opRetain, Topic: topic, Message: &StoredMessage{Qos: msg.Qos, Data: msg.Data}})
+}
+
+func (s *FileStorage) DeleteRetained(topic string) error {
+	return s.append(logRecord{Op: opDeleteRetained, Topic: topic})
+}
+
+func (s *FileStorage) PutSession(session *StoredSession) error {
+	return s.append(logRecord{Op: opSession, Session: session})
+}
+
+func (s *FileStorage) DeleteSession(clientId string) error {
+	return s.append(logRecord{Op: opDeleteSession, ClientId: clientId})
+}
+
+func (s *FileStorage) Load() (*StoredState, error) {
+	defer s.Unlock()
+	s.Lock()
+	state := &StoredState{
+		Topics:   make(map[uint16]string, len(s.state.Topics)),
+		Retained: make(map[string]StoredMessage, len(s.state.Retained)),
+		Sessions: make(map[string]*StoredSession, len(s.state.Sessions)),
+	}
+	for id, topic := range s.state.Topics {
+		state.Topics[id] = topic
+	}
+	for topic, msg := range s.state.Retained {
+		state.Retained[topic] = msg
+	}
+	for id, session := range s.state.Sessions {
+		state.Sessions[id] = session
+	}
+	return state, nil
+}
+
+func (s *FileStorage) Close() error {
+	defer s.Unlock()
+	s.Lock()
+	if err := s.compact(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func openTestStorage(t *testing.T, path string) *FileStorage {
+	t.Helper()
+	s, err := OpenFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// logLines returns the number of records in the log.
+func logLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte{'\n'})
+}
+
+func TestFileStorageReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.db")
+	s := openTestStorage(t, path)
+	session := &StoredSession{
+		ClientId:      "replay",
+		Subscriptions: map[string]byte{"/replay/#": 1},
+		Topics:        map[uint16]string{1: "/replay/a"},
+		Inflight:      []StoredMessage{{Topic: "/replay/a", TopicId: 1, MessageId: 7, Qos: 2, Released: true, Data: []byte("x")}},
+		Received:      []uint16{3},
+		NextMessageId: 7,
+	}
+	s.PutTopic(1, "/replay/a")
+	s.PutTopic(2, "/replay/b")
+	s.DeleteTopic(2)
+	s.PutRetained("/replay/a", NewPublishMessage(0, 0x00, []byte("old"), 0, 0, true, false))
+	s.PutRetained("/replay/a", NewPublishMessage(0, 0x00, []byte("new"), 1, 0, true, false))
+	s.PutRetained("/replay/b", NewPublishMessage(0, 0x00, []byte("b"), 0, 0, true, false))
+	s.DeleteRetained("/replay/b")
+	s.PutSession(session)
+	s.PutSession(&StoredSession{ClientId: "gone"})
+	s.DeleteSession("gone")
+	// The broker crashes: the log is not compacted.
+	s.file.Close()
+
+	want := &StoredState{
+		Topics:   map[uint16]string{1: "/replay/a"},
+		Retained: map[string]StoredMessage{"/replay/a": {Qos: 1, Data: []byte("new")}},
+		Sessions: map[string]*StoredSession{"replay": session},
+	}
+	s = openTestStorage(t, path)
+	defer s.Close()
+	if state, _ := s.Load(); !reflect.DeepEqual(state, want) {
+		t.Fatalf("got %+v, want %+v", state, want)
+	}
+	if n := logLines(t, path); n != 3 {
+		t.Fatal("log not compacted on open:", n, "records")
+	}
+}
+
+func TestFileStorageTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.db")
+	s := openTestStorage(t, path)
+	s.PutTopic(1, "/torn/a")
+	s.PutTopic(2, "/torn/b")
+	s.file.Write([]byte(`{"Op":"topic","TopicId":3,"To`))
+	s.file.Close()
+
+	s = openTestStorage(t, path)
+	if state, _ := s.Load(); !reflect.DeepEqual(state.Topics, map[uint16]string{1: "/torn/a", 2: "/torn/b"}) {
+		t.Fatal("got", state.Topics)
+	}
+	// Records written after the torn one are not lost behind it.
+	s.PutTopic(3, "/torn/c")
+	s.file.Close()
+	s = openTestStorage(t, path)
+	defer s.Close()
+	if state, _ := s.Load(); state.Topics[3] != "/torn/c" {
+		t.Fatal("got", state.Topics)
+	}
+}
+
+func TestFileStorageCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.db")
+	s := openTestStorage(t, path)
+	for i := 0; i < 3*compactionThreshold; i++ {
+		if err := s.PutRetained("/compact", NewPublishMessage(0, 0x00, []byte(strconv.Itoa(i)), 0, 0, true, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := logLines(t, path); n > compactionThreshold+3 {
+		t.Fatal("log not compacted:", n, "records")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := logLines(t, path); n != 1 {
+		t.Fatal("log not compacted on close:", n, "records")
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary file left behind")
+	}
+
+	s = openTestStorage(t, path)
+	defer s.Close()
+	if state, _ := s.Load(); string(state.Retained["/compact"].Data) != strconv.Itoa(3*compactionThreshold-1) {
+		t.Fatal("got", state.Retained)
+	}
+}
+
+// TestRestart runs a broker with a FileStorage, stops it, and checks that a
+// second broker with the same storage restores topic IDs, retained messages
+// and a persistent session with a message in flight. Both brokers run in
+// processes of their own, as InitBroker sets up global state.
+func TestRestart(t *testing.T) {
+	phase := os.Getenv("GOMQTT_RESTART_PHASE")
+	if phase == "" {
+		dir := t.TempDir()
+		for _, phase := range []string{"before", "after"} {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestRestart$")
+			cmd.Env = append(os.Environ(),
+				storagePathEnv+"="+filepath.Join(dir, "broker.db"),
+				"GOMQTT_RESTART_PHASE="+phase,
+				"GOMQTT_RESTART_DIR="+dir)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("%s: %s\n%s", phase, err, out)
+			}
+		}
+		return
+	}
+	idFile := filepath.Join(os.Getenv("GOMQTT_RESTART_DIR"), "topic-id")
+
+	if phase == "before" {
+		sub := dialSN(t)
+		sub.connect("restart-sub", false)
+		id := sub.register("/restart/topic")
+		sub.subscribe("/restart/topic", 1)
+		pub := dialSN(t)
+		pub.connect("restart-pub", true)
+		pub.send(NewPublishMessage(pub.register("/restart/topic"), 0x00, []byte("retained"), 1, 1, true, false))
+		if _, ok := pub.recv().(*PubackMessage); !ok {
+			t.Fatal("expected PUBACK")
+		}
+		// The message stays in flight, as it is not acknowledged.
+		if p := sub.receivePublish(); p.TopicId != id {
+			t.Fatal("bad topic ID", p.TopicId)
+		}
+		ShutdownBroker()
+		if err := ioutil.WriteFile(idFile, []byte(strconv.Itoa(int(id))), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	data, err := ioutil.ReadFile(idFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := strconv.Atoi(string(data))
+	if !serv.Config.Topics.PerClientIds && tIndex.getTopic(uint16(id)) != "/restart/topic" {
+		t.Fatal("topic ID not restored")
+	}
+
+	sub := dialSN(t)
+	sub.connect("restart-sub", false)
+	p := sub.receivePublish()
+	if !p.Dup || p.TopicId != uint16(id) || string(p.Data) != "retained" {
+		t.Fatalf("message in flight not restored: %#v", p)
+	}
+	ack := NewMessage(PUBACK).(*PubackMessage)
+	ack.TopicId = p.TopicId
+	ack.MessageId = p.MessageId
+	ack.ReturnCode = ACCEPTED
+	sub.send(ack)
+
+	other := dialSN(t)
+	other.connect("restart-other", true)
+	other.subscribe("/restart/topic", 0)
+	if p := other.receivePublish(); string(p.Data) != "retained" || !p.Retain {
+		t.Fatalf("retained message not restored: %#v", p)
+	}
+	other.publish(other.register("/restart/topic"), 0, "after restart")
+	if p := sub.receivePublish(); string(p.Data) != "after restart" {
+		t.Fatalf("subscription not restored: %#v", p)
+	}
+}
@@ -6,15 +6,24 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"time"
 )
 
 func ProcessPacket(nbytes int, buffer []byte, con *net.UDPConn, addr *net.UDPAddr) {
 	buffer = buffer[:nbytes]
 	buf := bytes.NewBuffer(buffer)
-	rawmsg, _ := ReadPacket(buf)
+	rawmsg, err := ReadPacket(buf)
 	if debug {
 		fmt.Println(hex.EncodeToString(buffer))
 	}
+	if err != nil {
+		// The packet is still handled if its type is known: bad topic names
+		// are answered with a return code.
+		log.Println("Bad packet from", addr.String(), ":", err)
+	}
+	if tclient := clients.GetClient(addr); tclient != nil {
+		tclient.Touch()
+	}
 
 	switch msg := rawmsg.(type) {
 	case *AdvertiseMessage:
@@ -33,122 +42,603 @@ func ProcessPacket(nbytes int, buffer []byte, con *net.UDPConn, addr *net.UDPAdd
 			log.Println(err)
 			return
 		}
-		tClient := NewClient(string(clientid), con, addr)
+		if certifiedClientId(clientid) {
+			// MQTT-SN clients have no certificates.
+			log.Println("Client id", clientid, "belongs to a certificate, refusing", addr.String())
+			ca := NewMessage(CONNACK).(*ConnackMessage)
+			ca.ReturnCode = REJ_NOT_SUPORTED
+			writeAddress(con, addr, ca)
+			return
+		}
+		if other := clients.GetClient(addr); other != nil && other.ClientId != clientid {
+			// Somebody else was connected from this address before. It is
+			// gone, and nothing may be sent to it here any more.
+			expireClient(other)
+		}
+		tClient, stale := clients.Takeover(clientid, con, addr)
+		if stale != nil {
+			log.Println("Client", clientid, "moved from", stale.String(), "to", addr.String())
+			// The stale endpoint is not connected anymore.
+			writeAddress(con, stale, NewMessage(DISCONNECT))
+		}
+		if tClient != nil && msg.CleanSession && !tClient.Sleeping() {
+			leave(tClient)
+			tClient = nil
+		}
+		if tClient == nil && !msg.CleanSession {
+			tClient = sessions.Take(clientid)
+			if tClient != nil {
+				if stream := tClient.Rebind(con, addr); stream != nil {
+					stream.disconnect(MQTT_SESSION_TAKEN_OVER)
+				}
+			}
+		}
+		wills.Resume(clientid, tClient != nil)
+		if tClient == nil {
+			sessions.Remove(clientid)
+			tClient = NewClient(clientid, con, addr)
+		}
+		// A sleeping client or a client resuming its session keeps its
+		// registrations and messages, but not its will.
+		tClient.SetWillTopic("", 0, false)
+		tClient.SetCleanSession(msg.CleanSession)
+		tClient.SetKeepAlive(msg.Duration)
 		if msg.Will {
-			// TODO: implement wills
+			// CONNACK is postponed until the client sends its will topic and
+			// will message.
+			tClient.SetState(stateWillTopic)
+			clients.AddClient(tClient)
+			if err = tClient.Write(NewMessage(WILLTOPICREQ)); err != nil {
+				log.Println(err)
+			}
+			return
 		}
 		clients.AddClient(tClient)
-		ca := NewMessage(CONNACK).(*ConnackMessage)
-		ca.ReturnCode = 0
-		if err = tClient.Write(ca); err != nil {
-			log.Println(err)
-		}
+		connack(tClient)
 	case *ConnackMessage:
 		// CONNACK is a next step of a MQTT-SN cluster system creation. As it was
 		// stated earlier, a broker is also a (forwarding) client for other brokers.
 	case *WillTopicReqMessage:
-		// WILLTOPICREQ lol
+		// WILLTOPICREQ is sent only by a broker to a client.
 	case *WillTopicMessage:
-		// WILLTOPIC lol
+		tclient := clients.GetClient(addr)
+		if tclient == nil || tclient.State() != stateWillTopic {
+			log.Println("Unexpected WILLTOPIC from", addr.String())
+			return
+		}
+		if len(msg.WillTopic) == 0 {
+			// An empty WILLTOPIC means that the client does not want a will
+			// after all.
+			tclient.SetWillTopic("", 0, false)
+			connack(tclient)
+			return
+		}
+		if _, err := ValidateTopicName(string(msg.WillTopic)); err != nil {
+			log.Println("Refusing connection of", tclient, ":", err)
+			tclient.SetWillTopic("", 0, false)
+			tclient.SetState(stateDisconnected)
+			leave(tclient)
+			ca := NewMessage(CONNACK).(*ConnackMessage)
+			ca.ReturnCode = REJ_NOT_SUPORTED
+			if err = tclient.Write(ca); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		tclient.SetWillTopic(string(msg.WillTopic), msg.Qos, msg.Retain)
+		tclient.SetState(stateWillMsg)
+		if err := tclient.Write(NewMessage(WILLMSGREQ)); err != nil {
+			log.Println(err)
+		}
 	case *WillMsgReqMessage:
-		// WILLMSGREQ lol
+		// WILLMSGREQ is sent only by a broker to a client.
 	case *WillMsgMessage:
-		// WILLMSQ lol
+		tclient := clients.GetClient(addr)
+		if tclient == nil || tclient.State() != stateWillMsg {
+			log.Println("Unexpected WILLMSG from", addr.String())
+			return
+		}
+		if !tclient.SetWillMsg(msg.WillMsg) {
+			log.Println("WILLMSG without will topic from", tclient)
+		}
+		connack(tclient)
 	case *RegisterMessage:
 		topic := string(msg.TopicName)
-		var topicid uint16
-		if !tIndex.containsTopic(topic) {
-			topicid = tIndex.putTopic(topic)
-		} else {
-			topicid = tIndex.getId(topic)
-		}
 		tclient := clients.GetClient(addr)
 		if tclient == nil {
 			log.Println("Received packet from non-existent user!")
 			return
 		}
-		tclient.Register(topicid, topic)
 		a := NewMessage(REGACK).(*RegackMessage)
-		a.TopicId = topicid
 		a.MessageId = msg.MessageId
-		a.ReturnCode = 0
+		a.ReturnCode = ACCEPTED
+		if _, err := ValidateTopicName(topic); err != nil {
+			log.Println(err)
+			a.ReturnCode = REJ_NOT_SUPORTED
+		} else if a.TopicId = registerTopic(tclient, topic); a.TopicId == 0 {
+			a.ReturnCode = REJ_CONGESTION
+		}
 		if err := tclient.Write(a); err != nil {
 			log.Println(err)
 		}
 	case *RegackMessage:
-		// REGACK may occur on broker level because brokers may also subscribe to
-		// (supposedly wildcard) topics on other brokers and forward messages.
+		tclient := clients.GetClient(addr)
+		if tclient == nil {
+			log.Println("Received packet from non-existent user!")
+			return
+		}
+		queued, ok := tclient.FinishRegistration(msg.MessageId, msg.ReturnCode == ACCEPTED)
+		if !ok {
+			log.Println("REGACK for unknown message", msg.MessageId, "from", tclient)
+			return
+		}
+		if msg.ReturnCode != ACCEPTED {
+			log.Println("Registration rejected by", tclient, "with code", msg.ReturnCode,
+				"dropping", len(queued), "messages")
+			return
+		}
+		for _, p := range queued {
+			topic, _ := tclient.RegisteredTopic(p.TopicId)
+			send(tclient, topic, p)
+		}
 	case *PublishMessage:
-		topic := tIndex.getTopic(msg.TopicId)
-		for _, client := range clients.clients {
-			if client.registeredTopics[msg.TopicId] == topic {
-				client.Write(msg)
+		tclient := clients.GetClient(addr)
+		if tclient == nil {
+			if msg.Qos == 3 && serv.Config.QoS.Connectionless {
+				publishConnectionless(msg)
+				return
+			}
+			log.Println("Received packet from non-existent user!")
+			return
+		}
+		topic, rc := publishedTopic(tclient, msg)
+		if rc != ACCEPTED {
+			log.Println("PUBLISH to unknown topic ID:", msg.TopicId)
+			a := NewMessage(PUBACK).(*PubackMessage)
+			a.ReturnCode = rc
+			a.MessageId = msg.MessageId
+			a.TopicId = msg.TopicId
+			if err := tclient.Write(a); err != nil {
+				log.Println(err)
 			}
+			return
 		}
-		if msg.Qos > 0 {
+		switch msg.Qos {
+		case 3:
+			// QoS -1 is delivered as QoS 0 to subscribers.
+			msg.Qos = 0
+			publish(topic, msg)
+		case 0:
+			publish(topic, msg)
+		case 1:
+			publish(topic, msg)
 			a := NewMessage(PUBACK).(*PubackMessage)
-			a.ReturnCode = 0
+			a.ReturnCode = ACCEPTED
 			a.MessageId = msg.MessageId
 			a.TopicId = msg.TopicId
-			clients.GetClient(addr).Write(a)
+			if err := tclient.Write(a); err != nil {
+				log.Println(err)
+			}
+		case 2:
+			// The message is forwarded right away, and its ID is kept until
+			// PUBREL so that retransmissions are not forwarded again.
+			if tclient.Receive(msg.MessageId) {
+				publish(topic, msg)
+			}
+			a := NewMessage(PUBREC).(*PubrecMessage)
+			a.MessageId = msg.MessageId
+			if err := tclient.Write(a); err != nil {
+				log.Println(err)
+			}
 		}
 	case *PubackMessage:
-		// PUBACK is needed if QoS level between brokers is >0.
+		tclient := clients.GetClient(addr)
+		if tclient == nil {
+			log.Println("Received packet from non-existent user!")
+			return
+		}
+		if !tclient.Acknowledge(msg.MessageId) {
+			log.Println("PUBACK for unknown message", msg.MessageId, "from", tclient)
+		}
+		if msg.ReturnCode != ACCEPTED {
+			log.Println("Message", msg.MessageId, "rejected by", tclient, "with code", msg.ReturnCode)
+		}
+		// Messages may be waiting for room within MaxInflight.
+		deliverQueued(tclient)
 	case *PubcompMessage:
-		// PUBCOMP is used by MQTT-SN itself to ensure that the message was
-		// delivered exactly once.
+		tclient := clients.GetClient(addr)
+		if tclient == nil {
+			log.Println("Received packet from non-existent user!")
+			return
+		}
+		if !tclient.Acknowledge(msg.MessageId) {
+			log.Println("PUBCOMP for unknown message", msg.MessageId, "from", tclient)
+		}
+		deliverQueued(tclient)
 	case *PubrecMessage:
-		// PUBREC is a first message sent in response by a broker on QoS 2
-		// to acknowledge the client that the message was received.
+		tclient := clients.GetClient(addr)
+		if tclient == nil {
+			log.Println("Received packet from non-existent user!")
+			return
+		}
+		// PUBREL is sent even for unknown messages: PUBCOMP of the client
+		// might have been lost before.
+		if !tclient.Confirm(msg.MessageId) {
+			log.Println("PUBREC for unknown message", msg.MessageId, "from", tclient)
+		}
+		a := NewMessage(PUBREL).(*PubrelMessage)
+		a.MessageId = msg.MessageId
+		if err := tclient.Write(a); err != nil {
+			log.Println(err)
+		}
 	case *PubrelMessage:
-		// PUBREL is a next step of MQTT-SN QoS 2 publication acknowledgement
-		// process that ensures the publication further, avoiding duplicate
-		// publishing.
+		tclient := clients.GetClient(addr)
+		if tclient == nil {
+			log.Println("Received packet from non-existent user!")
+			return
+		}
+		tclient.Release(msg.MessageId)
+		a := NewMessage(PUBCOMP).(*PubcompMessage)
+		a.MessageId = msg.MessageId
+		if err := tclient.Write(a); err != nil {
+			log.Println(err)
+		}
 	case *SubscribeMessage:
+		tclient := clients.GetClient(addr)
+		if tclient == nil {
+			log.Println("Received packet from non-existent user!")
+			return
+		}
 		var answer byte
 		var topicID uint16
+		var topic string
 		switch msg.TopicIdType {
-		case 0x00, 0x02:
-			if !tIndex.containsTopic(string(msg.TopicName)) {
-				topicID = tIndex.putTopic(string(msg.TopicName))
+		case 0x00:
+			topic = string(msg.TopicName)
+			if ContainsWildcard(topic) {
+				// Topic IDs of topics matching the filter are registered
+				// with the client as messages arrive, so SUBACK carries
+				// topic ID 0.
+				if _, err := ValidateTopicFilter(topic); err != nil {
+					log.Println(err)
+					answer = REJ_NOT_SUPORTED
+				}
+				break
+			}
+			if _, err := ValidateTopicName(topic); err != nil {
+				log.Println(err)
+				answer = REJ_NOT_SUPORTED
+				break
+			}
+			topicID = registerTopic(tclient, topic)
+			if topicID == 0 {
+				answer = REJ_CONGESTION
 			}
 		case 0x01:
-			if !tIndex.containsId(msg.TopicId) {
-				log.Println("requested topic ID not found:", msg.TopicId)
+			if !tIndex.isPredefined(msg.TopicId) {
+				log.Println("requested predefined topic ID not found:", msg.TopicId)
 				answer = REJ_INVALID_TID
 			}
 			topicID = msg.TopicId
+			topic = tIndex.getTopic(topicID)
+		case 0x02:
+			// Short topic names are not registered, so the topic ID in SUBACK
+			// is not relevant.
+			topic = string(msg.TopicName)
+		default:
+			answer = REJ_NOT_SUPORTED
+		}
+		if answer == ACCEPTED {
+			tclient.Subscribe(topic, msg.Qos)
 		}
-		clients.GetClient(addr).Register(topicID, tIndex.getTopic(topicID))
 		ack := NewMessage(SUBACK).(*SubackMessage)
 		ack.MessageId = msg.MessageId
 		ack.Qos = msg.Qos
 		ack.ReturnCode = answer
 		ack.TopicId = topicID
-		tclient := clients.GetClient(addr)
-		tclient.Write(ack)
+		if err := tclient.Write(ack); err != nil {
+			log.Println(err)
+		}
+		if answer == ACCEPTED {
+			deliverRetained(tclient, topic, msg.Qos)
+		}
 	case *SubackMessage:
 		// SUBACK is processed by a broker as well when subscribing to other
 		// brokers.
+	case *UnsubscribeMessage:
+		tclient := clients.GetClient(addr)
+		if tclient == nil {
+			log.Println("Received packet from non-existent user!")
+			return
+		}
+		var topic string
+		switch msg.TopicIdType {
+		case 0x00, 0x02:
+			topic = string(msg.TopicName)
+		case 0x01:
+			if tIndex.isPredefined(msg.TopicId) {
+				topic = tIndex.getTopic(msg.TopicId)
+			}
+		}
+		// UNSUBACK carries no return code, so it is sent even if the client
+		// was not subscribed.
+		if topic == "" || !tclient.Unsubscribe(topic) {
+			log.Println(tclient, "is not subscribed to", topic)
+		}
+		a := NewMessage(UNSUBACK).(*UnsubackMessage)
+		a.MessageId = msg.MessageId
+		if err := tclient.Write(a); err != nil {
+			log.Println(err)
+		}
 	case *UnsubackMessage:
 		// UNSUBACK is processed by a broker as well when subscribing to other
 		// brokers.
 	case *PingreqMessage:
+		tclient := clients.GetClient(addr)
+		if id := string(msg.ClientId); id != "" && (tclient == nil || tclient.ClientId != id) {
+			// The NAT mapping of a sleeping client may change while it
+			// sleeps.
+			tclient = nil
+			if c := clients.GetClientById(id); c != nil && c.Stream() == nil && c.State() == stateAsleep {
+				if other := clients.GetClient(addr); other != nil {
+					expireClient(other)
+				}
+				var stale *net.UDPAddr
+				tclient, stale = clients.Takeover(id, con, addr)
+				if stale != nil {
+					log.Println("Client", id, "moved from", stale.String(), "to", addr.String())
+				}
+			}
+		}
+		if tclient == nil {
+			log.Println("Received packet from non-existent user!")
+			return
+		}
+		if len(msg.ClientId) > 0 && tclient.State() == stateAsleep {
+			// A sleeping client checks for buffered messages: deliver them
+			// and let it go back to sleep with PINGRESP.
+			tclient.SetState(stateAwake)
+			deliverQueued(tclient)
+			tclient.SetState(stateAsleep)
+		}
 		a := NewMessage(PINGRESP).(*PingrespMessage)
-		clients.GetClient(addr).Write(a)
+		if err := tclient.Write(a); err != nil {
+			log.Println(err)
+		}
 	case *DisconnectMessage:
 		tclient := clients.GetClient(addr)
+		if tclient == nil {
+			log.Println("Received packet from non-existent user!")
+			return
+		}
+		if msg.Duration != 0 {
+			tclient.Sleep(msg.Duration)
+		} else {
+			// The client has left cleanly, so its will must not be published.
+			tclient.SetWillTopic("", 0, false)
+			tclient.SetState(stateDisconnected)
+			leave(tclient)
+		}
 		msg.Duration = 0
-		tclient.Write(msg)
+		if err := tclient.Write(msg); err != nil {
+			log.Println(err)
+		}
 	case *WillTopicUpdateMessage:
-		// WILLTOPICUPD lol
+		tclient := clients.GetClient(addr)
+		if tclient == nil {
+			log.Println("Received packet from non-existent user!")
+			return
+		}
+		a := NewMessage(WILLTOPICRESP).(*WillTopicRespMessage)
+		a.ReturnCode = ACCEPTED
+		if len(msg.WillTopic) == 0 {
+			// An empty WILLTOPICUPD deletes both will topic and will message.
+			tclient.SetWillTopic("", 0, false)
+		} else if _, err := ValidateTopicName(string(msg.WillTopic)); err != nil {
+			log.Println(err)
+			a.ReturnCode = REJ_NOT_SUPORTED
+		} else {
+			tclient.SetWillTopic(string(msg.WillTopic), msg.Qos, msg.Retain)
+		}
+		if err := tclient.Write(a); err != nil {
+			log.Println(err)
+		}
 	case *WillTopicRespMessage:
-		// WILLTOPICRESP lol
+		// WILLTOPICRESP is sent only by a broker to a client.
 	case *WillMsgUpdateMessage:
-		// WILLMSGUPD lol
+		tclient := clients.GetClient(addr)
+		if tclient == nil {
+			log.Println("Received packet from non-existent user!")
+			return
+		}
+		a := NewMessage(WILLMSGRESP).(*WillMsgRespMessage)
+		a.ReturnCode = ACCEPTED
+		if !tclient.SetWillMsg(msg.WillMsg) {
+			log.Println("WILLMSGUPD without will topic from", tclient)
+			a.ReturnCode = REJ_NOT_SUPORTED
+		}
+		if err := tclient.Write(a); err != nil {
+			log.Println(err)
+		}
 	case *WillMsgRespMessage:
-		// WILLMSGRESP lol
+		// WILLMSGRESP is sent only by a broker to a client.
 	default:
 		log.Printf("Unknown Message Type %T\n", msg)
 	}
 }
+
+// writeAddress sends a message to an address directly, without a client.
+func writeAddress(con *net.UDPConn, addr *net.UDPAddr, m Message) {
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		log.Println(err)
+		return
+	}
+	if _, err := con.WriteToUDP(buf.Bytes(), addr); err != nil {
+		log.Println(err)
+	}
+}
+
+// connack completes the connection of a client.
+func connack(c *Client) {
+	c.SetState(stateActive)
+	ca := NewMessage(CONNACK).(*ConnackMessage)
+	ca.ReturnCode = ACCEPTED
+	if err := c.Write(ca); err != nil {
+		log.Println(err)
+	}
+	// Messages in flight of a resumed session are sent again right away.
+	retransmit(c, time.Now(), 0)
+	deliverQueued(c)
+}
+
+// deliverQueued sends messages queued while the client was asleep or
+// disconnected, in order.
+func deliverQueued(c *Client) {
+	for _, q := range c.FetchQueued() {
+		deliver(c, q.topic, q.msg)
+	}
+}
+
+// publishedTopic resolves the topic name of a PUBLISH received from a client.
+// The return code is REJ_INVALID_TID if the topic ID is unknown to the client.
+func publishedTopic(c *Client, msg *PublishMessage) (string, byte) {
+	switch msg.TopicIdType {
+	case 0x00:
+		topic, ok := c.RegisteredTopic(msg.TopicId)
+		if !ok {
+			return "", REJ_INVALID_TID
+		}
+		return topic, ACCEPTED
+	case 0x01:
+		if !tIndex.isPredefined(msg.TopicId) {
+			return "", REJ_INVALID_TID
+		}
+		return tIndex.getTopic(msg.TopicId), ACCEPTED
+	case 0x02:
+		return shortTopic(msg.TopicId), ACCEPTED
+	}
+	return "", REJ_NOT_SUPORTED
+}
+
+// deliveredTopic returns the topic ID and its type to deliver a message on
+// the topic to the client with. Predefined topic IDs are preferred, then IDs
+// registered by the client, then short topic names. Other topics must be
+// registered with the client first, which is reported by returning false.
+// With per-client topic IDs, their IDs are assigned on registration.
+func deliveredTopic(c *Client, topic string) (uint16, byte, bool) {
+	if topicid := tIndex.getId(topic); topicid != 0 && tIndex.isPredefined(topicid) {
+		return topicid, 0x01, true
+	}
+	if topicid := c.RegisteredId(topic); topicid != 0 {
+		return topicid, 0x00, true
+	}
+	if isShortTopic(topic) {
+		return shortTopicId(topic), 0x02, true
+	}
+	if serv.Config.Topics.PerClientIds {
+		return 0, 0x00, false
+	}
+	return tIndex.putTopic(topic), 0x00, false
+}
+
+// registerTopic registers a topic requested by the client and returns its
+// topic ID, or 0 if there is no topic ID left.
+func registerTopic(c *Client, topic string) uint16 {
+	if serv.Config.Topics.PerClientIds {
+		return c.RegisterTopic(topic)
+	}
+	topicid := tIndex.putTopic(topic)
+	if topicid != 0 {
+		c.Register(topicid, topic)
+	}
+	return topicid
+}
+
+// deliver sends a message on the topic to the client, queueing it if the
+// client is asleep or disconnected and registering the topic with the client
+// if needed.
+func deliver(c *Client, topic string, p *PublishMessage) {
+	if p.Properties.expired(time.Now()) {
+		return
+	}
+	if c.Hold(topic, p) {
+		return
+	}
+	if c.Stream() != nil {
+		sendMQTT(c, topic, p)
+		return
+	}
+	topicid, topicIdType, known := deliveredTopic(c, topic)
+	p.TopicId = topicid
+	p.TopicIdType = topicIdType
+	if !known {
+		var messageId uint16
+		var queued bool
+		topicid, messageId, queued = c.StartRegistration(topicid, topic, p)
+		if topicid == 0 {
+			log.Println("No topic ID or message ID left to deliver", topic, "to", c)
+			return
+		}
+		if !queued {
+			// The client acknowledged the registration in the meantime.
+			send(c, topic, p)
+			return
+		}
+		if messageId != 0 {
+			if err := c.Write(NewRegisterMessage(topicid, messageId, []byte(topic))); err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
+	send(c, topic, p)
+}
+
+// publish forwards a message to every client subscribed to the topic and
+// returns the number of those clients. Each subscriber gets its own copy with
+// the lower of the publication and the subscription QoS levels. Retained
+// messages are stored, but forwarded to current subscribers as normal ones
+// unless they asked to keep the retain flag.
+func publish(topic string, msg *PublishMessage) int {
+	if msg.Retain {
+		retained.store(topic, msg)
+	}
+	forwarded := 0
+	for client, options := range subscriptions.match(topic) {
+		if options&subNoLocal != 0 && msg.Properties != nil && msg.Properties.origin == client.ClientId {
+			continue
+		}
+		qos := options & subQosBits
+		if msg.Qos < qos {
+			qos = msg.Qos
+		}
+		retain := msg.Retain && options&subRetainAsPublished != 0
+		p := NewPublishMessage(0, 0x00, msg.Data, qos, 0, retain, false)
+		p.Properties = msg.Properties
+		deliver(client, topic, p)
+		forwarded++
+	}
+	return forwarded
+}
+
+// publishConnectionless forwards a QoS -1 message sent by a client that is not
+// connected. Such messages may only use predefined or short topic IDs.
+func publishConnectionless(msg *PublishMessage) {
+	var topic string
+	switch msg.TopicIdType {
+	case 0x01:
+		if !tIndex.isPredefined(msg.TopicId) {
+			log.Println("QoS -1 message to unknown predefined topic ID:", msg.TopicId)
+			return
+		}
+		topic = tIndex.getTopic(msg.TopicId)
+	case 0x02:
+		topic = shortTopic(msg.TopicId)
+	default:
+		log.Println("QoS -1 message with normal topic ID:", msg.TopicId)
+		return
+	}
+	msg.Qos = 0
+	publish(topic, msg)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestConnectFromReusedAddress(t *testing.T) {
+	a := dialSN(t)
+	a.connect("reuse-a", false)
+	a.subscribe("/reuse/secret", 1)
+
+	// A NAT gives the address of A to B.
+	a.connect("reuse-b", true)
+
+	c := dialSN(t)
+	c.connect("reuse-c", true)
+	id := c.register("/reuse/secret")
+	c.publish(id, 1, "secret")
+	if _, ok := c.recv().(*PubackMessage); !ok {
+		t.Fatal("expected PUBACK")
+	}
+	a.expectNone()
+
+	// A gets the message once it is back.
+	a2 := dialSN(t)
+	a2.connect("reuse-a", false)
+	if p := a2.receivePublish(); string(p.Data) != "secret" {
+		t.Fatalf("got %q", p.Data)
+	}
+}
+
+func TestPingreqFromNewAddress(t *testing.T) {
+	a := dialSN(t)
+	a.connect("moving", true)
+	a.subscribe("/moving", 0)
+	sleep := NewMessage(DISCONNECT).(*DisconnectMessage)
+	sleep.Duration = 60
+	a.send(sleep)
+	if _, ok := a.recv().(*DisconnectMessage); !ok {
+		t.Fatal("expected DISCONNECT")
+	}
+
+	c := dialSN(t)
+	c.connect("moving-pub", true)
+	c.publish(c.register("/moving"), 0, "while asleep")
+
+	// The client wakes up behind another NAT mapping.
+	b := dialSN(t)
+	ping := NewMessage(PINGREQ).(*PingreqMessage)
+	ping.ClientId = []byte("moving")
+	b.send(ping)
+	if p := b.receivePublish(); string(p.Data) != "while asleep" {
+		t.Fatalf("got %q", p.Data)
+	}
+	if _, ok := b.recv().(*PingrespMessage); !ok {
+		t.Fatal("expected PINGRESP")
+	}
+	a.expectNone()
+	if client := clients.GetClient(b.conn.LocalAddr().(*net.UDPAddr)); client == nil || client.ClientId != "moving" {
+		t.Fatal("client not moved to the new address")
+	}
+}
+
+func TestInvalidWillTopic(t *testing.T) {
+	c := dialSN(t)
+	m := NewMessage(CONNECT).(*ConnectMessage)
+	m.ClientId = []byte("badwill")
+	m.Will = true
+	m.CleanSession = true
+	c.send(m)
+	if _, ok := c.recv().(*WillTopicReqMessage); !ok {
+		t.Fatal("expected WILLTOPICREQ")
+	}
+	w := NewMessage(WILLTOPIC).(*WillTopicMessage)
+	w.WillTopic = []byte("/will/#")
+	c.send(w)
+	if ack, ok := c.recv().(*ConnackMessage); !ok || ack.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatal("expected CONNACK refusing the connection")
+	}
+	if clients.GetClientById("badwill") != nil {
+		t.Fatal("refused client still connected")
+	}
+	c.connect("badwill", true)
+}
+
+func TestRegisterInvalidTopic(t *testing.T) {
+	c := dialSN(t)
+	c.connect("register-invalid", true)
+	for _, topic := range []string{"rwx/#", "/rwx/+", "/rwx/#"} {
+		c.send(NewRegisterMessage(0, 2, []byte(topic)))
+		ack, ok := c.recv().(*RegackMessage)
+		if !ok || ack.ReturnCode != REJ_NOT_SUPORTED || ack.TopicId != 0 {
+			t.Fatalf("registration of %s not refused: %#v", topic, ack)
+		}
+	}
+	if id := c.register("/rwx/valid"); id == 0 {
+		t.Fatal("no topic ID for a valid topic")
+	}
+}
+
+func TestConnectionlessPublish(t *testing.T) {
+	sub := dialSN(t)
+	sub.connect("connectionless-sub", true)
+	sub.subscribe("/predefined", 0)
+	sub.subscribeTo(0x02, "cl", 0)
+
+	// The publisher never connects.
+	anon := dialSN(t)
+	anon.send(NewPublishMessage(100, 0x01, []byte("predefined"), 3, 0, false, false))
+	if p := sub.receivePublish(); string(p.Data) != "predefined" || p.Qos != 0 {
+		t.Fatalf("got %#v", p)
+	}
+	anon.send(NewPublishMessage(shortTopicId("cl"), 0x02, []byte("short"), 3, 0, false, false))
+	if p := sub.receivePublish(); string(p.Data) != "short" || p.TopicIdType != 0x02 {
+		t.Fatalf("got %#v", p)
+	}
+	// Normal topic IDs and unknown predefined ones mean nothing without a
+	// connection, and QoS 0 needs one.
+	anon.send(NewPublishMessage(tIndex.getId("/predefined"), 0x00, []byte("normal"), 3, 0, false, false))
+	anon.send(NewPublishMessage(101, 0x01, []byte("unknown"), 3, 0, false, false))
+	anon.send(NewPublishMessage(100, 0x01, []byte("qos 0"), 0, 0, false, false))
+	sub.expectNone()
+	anon.expectNone()
+}
+
+func TestShortTopics(t *testing.T) {
+	sub := dialSN(t)
+	sub.connect("short-sub", true)
+	sub.subscribeTo(0x02, "st", 1)
+	wild := dialSN(t)
+	wild.connect("short-wild", true)
+	wild.subscribe("+", 0)
+	m := dialMQTT(t, 4)
+	m.connect("short-mqtt", true, nil)
+	m.subscribe("st", 0)
+
+	pub := dialSN(t)
+	pub.connect("short-pub", true)
+	pub.send(NewPublishMessage(shortTopicId("st"), 0x02, []byte("short"), 1, 1, false, false))
+	if ack, ok := pub.recv().(*PubackMessage); !ok || ack.ReturnCode != ACCEPTED {
+		t.Fatalf("expected PUBACK, got %#v", ack)
+	}
+	// Short topic names are sent inline, without REGISTER.
+	for _, c := range []*snClient{sub, wild} {
+		p, ok := c.recv().(*PublishMessage)
+		if !ok || p.TopicIdType != 0x02 || p.TopicId != shortTopicId("st") || string(p.Data) != "short" {
+			t.Fatalf("got %#v", p)
+		}
+	}
+	if msg := m.receivePublish(); msg.Topic != "st" {
+		t.Fatalf("got %+v", msg)
+	}
+
+	sub.unsubscribe(0x02, "st")
+	pub.send(NewPublishMessage(shortTopicId("st"), 0x02, []byte("again"), 0, 0, false, false))
+	if p := wild.receivePublish(); string(p.Data) != "again" {
+		t.Fatalf("got %#v", p)
+	}
+	sub.expectNone()
+}
+
+func TestUnsubscribe(t *testing.T) {
+	sub := dialSN(t)
+	sub.connect("unsub-sub", true)
+	sub.subscribe("/unsub/a", 0)
+	sub.subscribe("/unsub/+", 0)
+	sub.subscribeTo(0x01, "100", 0)
+	pub := dialSN(t)
+	pub.connect("unsub-pub", true)
+	id := pub.register("/unsub/a")
+
+	pub.publish(id, 0, "both")
+	sub.receivePublish()
+	sub.expectNone()
+	sub.unsubscribe(0x00, "/unsub/a")
+	pub.publish(id, 0, "wildcard")
+	if p := sub.receivePublish(); string(p.Data) != "wildcard" {
+		t.Fatalf("got %q", p.Data)
+	}
+	sub.unsubscribe(0x00, "/unsub/+")
+	pub.publish(id, 0, "none")
+	sub.expectNone()
+
+	pub.send(NewPublishMessage(100, 0x01, []byte("predefined"), 0, 0, false, false))
+	if p := sub.receivePublish(); string(p.Data) != "predefined" {
+		t.Fatalf("got %q", p.Data)
+	}
+	sub.unsubscribe(0x01, "100")
+	pub.send(NewPublishMessage(100, 0x01, []byte("none"), 0, 0, false, false))
+	sub.expectNone()
+
+	// UNSUBACK has no return code, so it is sent for unknown filters too.
+	sub.unsubscribe(0x00, "/unsub/never")
+}
+
+// BenchmarkPublish publishes messages on 100k topics that 1000 MQTT clients
+// are subscribed to, some of them through wildcards, as in
+// BenchmarkMatchSubscriptions. The clients read and drop what they get over
+// pipes. MQTT clients are used because 100k topics do not fit into the topic
+// ID space of MQTT-SN clients.
+func BenchmarkPublish(b *testing.B) {
+	subscribers := make([]*Client, 1000)
+	for i := range subscribers {
+		client, server := net.Pipe()
+		go io.Copy(ioutil.Discard, client)
+		defer client.Close()
+		subscribers[i] = NewClient("bench-publish-mqtt-"+strconv.Itoa(i), nil, nil)
+		subscribers[i].Attach(&mqttConn{Conn: server, version: 4, receiveMaximum: 65535, maxPacketSize: mqttMaxLength + 5})
+	}
+	var filters []string
+	var owners []*Client
+	subscribe := func(filter string, c *Client) {
+		subscriptions.subscribe(filter, c, 0)
+		filters = append(filters, filter)
+		owners = append(owners, c)
+	}
+	defer func() {
+		for i, filter := range filters {
+			subscriptions.unsubscribe(filter, owners[i])
+		}
+	}()
+	for i := 0; i < benchTopics; i++ {
+		subscribe(benchTopicName(i), subscribers[i%len(subscribers)])
+	}
+	for i := 0; i < 100; i++ {
+		subscribe("/sensors/"+strconv.Itoa(i)+"/+", subscribers[i])
+	}
+	subscribe("/sensors/#", subscribers[0])
+
+	msg := NewPublishMessage(0, 0x00, []byte("22.5"), 0, 0, false, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if publish(benchTopicName(i%benchTopics), msg) == 0 {
+			b.Fatal("no subscribers")
+		}
+	}
+}
+
+// BenchmarkPublishMQTTSN publishes messages on 1000 topics, each of which goes
+// to ten of 1000 MQTT-SN clients through a wildcard. One of them is subscribed
+// to the topic itself as well. The clients know their topics already, and
+// messages go to a UDP socket nobody reads. There are fewer topics than in
+// BenchmarkPublish, as every client needs a topic ID for each.
+func BenchmarkPublishMQTTSN(b *testing.B) {
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	topics := make([]string, 1000)
+	for i := range topics {
+		topics[i] = "/bench/publish/" + strconv.Itoa(i%100) + "/" + strconv.Itoa(i)
+	}
+	subscribers := make([]*Client, len(topics))
+	for i := range subscribers {
+		c := NewClient("bench-publish-"+strconv.Itoa(i), conn, sink.LocalAddr().(*net.UDPAddr))
+		wildcard := "/bench/publish/" + strconv.Itoa(i%100) + "/+"
+		subscriptions.subscribe(topics[i], c, 0)
+		subscriptions.subscribe(wildcard, c, 0)
+		for _, topic := range topics {
+			if topic == topics[i] || MatchTopic(wildcard, topic) {
+				if registerTopic(c, topic) == 0 {
+					b.Fatal("no topic ID left")
+				}
+			}
+		}
+		subscribers[i] = c
+	}
+	defer func() {
+		for i, c := range subscribers {
+			subscriptions.unsubscribe(topics[i], c)
+			subscriptions.unsubscribe("/bench/publish/"+strconv.Itoa(i%100)+"/+", c)
+		}
+	}()
+
+	msg := NewPublishMessage(0, 0x00, []byte("22.5"), 0, 0, false, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if publish(topics[i%len(topics)], msg) != 10 {
+			b.Fatal("message not delivered to ten clients")
+		}
+	}
+}
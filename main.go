@@ -19,12 +19,47 @@ var serv struct {
 	Config struct {
 		MQTTAddress   string
 		MQTTSNAddress string
+		WSAddress     string
+		WSPath        string
 		Buffer int
+		MaxPacketSize int
 		Log   struct {
 			Path string
 			UTC  bool
 			Debug bool
 		}
+		Session struct {
+			GracePeriod int
+			IdleTimeout int
+		}
+		QoS struct {
+			RetryInterval  int
+			MaxRetries     int
+			MaxInflight    int
+			Connectionless bool
+		}
+		Queue struct {
+			MaxMessages int
+			MaxBytes    int
+			MaxAge      int
+			DropPolicy  string
+		}
+		Storage struct {
+			Path string
+		}
+		Topics struct {
+			PerClientIds bool
+		}
+		TLS struct {
+			Cert       string
+			Key        string
+			CA         string
+			MinVersion string
+			ClientAuth string
+			Identity   string
+			IdentityAs string
+		}
+		PredefinedTopics map[string]string
 	}
 }
 
@@ -39,6 +74,12 @@ func LoadConfig(path string) error {
 	}
 	defer file.Close()
 
+	serv.Config.MaxPacketSize = 1048576
+	serv.Config.QoS.RetryInterval = 10
+	serv.Config.QoS.MaxRetries = 3
+	serv.Config.QoS.MaxInflight = 10
+	serv.Config.Queue.MaxMessages = 100
+	serv.Config.Queue.DropPolicy = "oldest"
 	if _, err := toml.DecodeReader(file, &serv.Config); err != nil {
 		return err
 	}
@@ -72,13 +113,30 @@ func main() {
 	}
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	storage, err := OpenStorage()
+	if err != nil {
+		log.Fatalln("Unable to open storage:", err)
+	}
+	if err = InitBroker(storage); err != nil {
+		log.Fatalln(err)
+	}
+	if err = LoadTLS(); err != nil {
+		log.Fatalln("Unable to set up TLS:", err)
+	}
+
 	if serv.Config.MQTTSNAddress != "" {
 		log.Println("Starting UDP listener on address", serv.Config.MQTTSNAddress)
 		go ListenUDP(serv.Config.MQTTSNAddress)
 	}
 
 	if serv.Config.MQTTAddress != "" {
-		log.Println("TCP listener is not implemented yet!")
+		log.Println("Starting TCP listener on address", serv.Config.MQTTAddress)
+		go ListenTCP(serv.Config.MQTTAddress)
+	}
+
+	if serv.Config.WSAddress != "" {
+		log.Println("Starting WebSocket listener on address", serv.Config.WSAddress)
+		go ListenWS(serv.Config.WSAddress, serv.Config.WSPath)
 	}
 
 	// Shutdown gracefully on signal
@@ -88,4 +146,6 @@ func main() {
 		syscall.SIGINT,
 		syscall.SIGQUIT)
 	<-c
+	log.Println("Shutting down")
+	ShutdownBroker()
 }
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// MQTT control packet types
+const (
+	MQTT_CONNECT     = 0x01
+	MQTT_CONNACK     = 0x02
+	MQTT_PUBLISH     = 0x03
+	MQTT_PUBACK      = 0x04
+	MQTT_PUBREC      = 0x05
+	MQTT_PUBREL      = 0x06
+	MQTT_PUBCOMP     = 0x07
+	MQTT_SUBSCRIBE   = 0x08
+	MQTT_SUBACK      = 0x09
+	MQTT_UNSUBSCRIBE = 0x0A
+	MQTT_UNSUBACK    = 0x0B
+	MQTT_PINGREQ     = 0x0C
+	MQTT_PINGRESP    = 0x0D
+	MQTT_DISCONNECT  = 0x0E
+)
+
+// CONNACK return codes
+const (
+	MQTT_ACCEPTED           = 0x00
+	MQTT_REJ_PROTOCOL       = 0x01
+	MQTT_REJ_IDENTIFIER     = 0x02
+	MQTT_REJ_UNAVAILABLE    = 0x03
+	MQTT_REJ_CREDENTIALS    = 0x04
+	MQTT_REJ_NOT_AUTHORIZED = 0x05
+)
+
+// SUBACK return code of a rejected subscription
+const MQTT_SUBSCRIBE_FAILURE = 0x80
+
+// mqttMaxLength is the largest remaining length of a control packet.
+const mqttMaxLength = 268435455
+
+var errMalformed = errors.New("malformed MQTT packet")
+
+var errTooLarge = &mqttError{MQTT_PACKET_TOO_LARGE, "MQTT packet too large"}
+
+// mqttPacket is an MQTT control packet as it is sent over the wire: the type
+// and flags of the fixed header, followed by the variable header and the
+// payload.
+type mqttPacket struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// readMQTTPacket reads a packet of at most max bytes, including the fixed
+// header. Larger packets are refused before their body is read.
+func readMQTTPacket(r *bufio.Reader, max int) (*mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := 0
+	for i := uint(0); ; i += 7 {
+		if i > 21 {
+			return nil, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7F) << i
+		// The length only grows with further bytes.
+		if 2+int(i/7)+length > max {
+			return nil, errTooLarge
+		}
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	p := &mqttPacket{Type: header >> 4, Flags: header & 0x0F, Body: make([]byte, length)}
+	if _, err = io.ReadFull(r, p.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Write sends the packet with a single write, so that packets written by
+// different goroutines do not interleave.
+func (p *mqttPacket) Write(w io.Writer) error {
+	if len(p.Body) > mqttMaxLength {
+		return errors.New("MQTT packet too large")
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(p.Type<<4 | p.Flags)
+	writeVarint(&buf, len(p.Body))
+	buf.Write(p.Body)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// mqttReader decodes the fields of a packet body. The first error is kept
+// and makes all further reads return zero values.
+type mqttReader struct {
+	b   []byte
+	err error
+}
+
+func (r *mqttReader) byte() byte {
+	if r.err != nil || len(r.b) < 1 {
+		r.err = errMalformed
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *mqttReader) uint16() uint16 {
+	if r.err != nil || len(r.b) < 2 {
+		r.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *mqttReader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err != nil || len(r.b) < n {
+		r.err = errMalformed
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+// string reads a UTF-8 encoded string, which may not contain U+0000.
+func (r *mqttReader) string() string {
+	v := r.bytes()
+	if r.err == nil && (!utf8.Valid(v) || bytes.IndexByte(v, 0) >= 0) {
+		r.err = errMalformed
+	}
+	return string(v)
+}
+
+func (r *mqttReader) rest() []byte {
+	v := r.b
+	r.b = nil
+	return v
+}
+
+func (r *mqttReader) empty() bool {
+	return len(r.b) == 0
+}
+
+func writeMQTTString(buf *bytes.Buffer, s []byte) {
+	buf.Write(encodeUint16(uint16(len(s))))
+	buf.Write(s)
+}
+
+// newMQTTAck returns PUBACK, PUBREC, PUBREL or PUBCOMP. A reason code other
+// than success may only be sent to MQTT 5.0 clients.
+func newMQTTAck(packetType byte, packetId uint16, reason byte) *mqttPacket {
+	p := &mqttPacket{Type: packetType, Body: encodeUint16(packetId)}
+	if packetType == MQTT_PUBREL {
+		p.Flags = 0x02
+	}
+	if reason != MQTT_SUCCESS {
+		p.Body = append(p.Body, reason)
+	}
+	return p
+}
+
+type mqttConnect struct {
+	ProtocolName  string
+	ProtocolLevel byte
+	// Clean Start in MQTT 5.0
+	CleanSession bool
+	KeepAlive    uint16
+	Properties   *mqttProperties
+	ClientId     string
+	Will         *Will
+	Username     *string
+	Password     []byte
+}
+
+// parseMQTTConnect decodes CONNECT of MQTT 3.1.1 or 5.0. An unsupported
+// protocol level is not an error, so that it can be refused with CONNACK.
+func parseMQTTConnect(p *mqttPacket) (*mqttConnect, error) {
+	r := &mqttReader{b: p.Body}
+	m := &mqttConnect{}
+	m.ProtocolName = r.string()
+	m.ProtocolLevel = r.byte()
+	flags := r.byte()
+	m.KeepAlive = r.uint16()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if m.ProtocolName != "MQTT" || flags&0x01 != 0 {
+		return nil, errors.New("not an MQTT CONNECT")
+	}
+	if m.ProtocolLevel != 4 && m.ProtocolLevel != 5 {
+		return m, nil
+	}
+	m.CleanSession = flags&0x02 != 0
+	if m.ProtocolLevel == 5 {
+		m.Properties = r.properties()
+	}
+	m.ClientId = r.string()
+	if flags&0x04 != 0 {
+		m.Will = &Will{Qos: flags >> 3 & 0x03, Retain: flags&0x20 != 0}
+		if m.ProtocolLevel == 5 {
+			m.Will.Properties = r.properties()
+		}
+		m.Will.Topic = r.string()
+		m.Will.Msg = r.bytes()
+		if m.Will.Qos > 2 {
+			return nil, errors.New("bad will QoS level")
+		}
+	} else if flags&0x38 != 0 {
+		return nil, errors.New("will flags without will")
+	}
+	if flags&0x80 != 0 {
+		username := r.string()
+		m.Username = &username
+	}
+	if flags&0x40 != 0 {
+		m.Password = r.bytes()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return m, nil
+}
+
+// newMQTTConnack returns CONNACK. Properties are only sent to MQTT 5.0
+// clients and must be nil for others.
+func newMQTTConnack(sessionPresent bool, returnCode byte, props *mqttPropertyWriter) *mqttPacket {
+	var buf bytes.Buffer
+	if sessionPresent {
+		buf.WriteByte(0x01)
+	} else {
+		buf.WriteByte(0x00)
+	}
+	buf.WriteByte(returnCode)
+	if props != nil {
+		props.writeTo(&buf)
+	}
+	return &mqttPacket{Type: MQTT_CONNACK, Body: buf.Bytes()}
+}
+
+type mqttPublish struct {
+	Topic      string
+	PacketId   uint16
+	Qos        byte
+	Retain     bool
+	Dup        bool
+	Properties *mqttProperties
+	Payload    []byte
+}
+
+func parseMQTTPublish(p *mqttPacket, version byte) (*mqttPublish, error) {
+	r := &mqttReader{b: p.Body}
+	m := &mqttPublish{
+		Qos:    p.Flags >> 1 & 0x03,
+		Retain: p.Flags&0x01 != 0,
+		Dup:    p.Flags&0x08 != 0,
+	}
+	if m.Qos > 2 {
+		return nil, errors.New("bad QoS level")
+	}
+	m.Topic = r.string()
+	if m.Qos > 0 {
+		m.PacketId = r.uint16()
+		if r.err == nil && m.PacketId == 0 {
+			return nil, errors.New("packet identifier 0")
+		}
+	}
+	if version == 5 {
+		m.Properties = r.properties()
+	}
+	m.Payload = r.rest()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return m, nil
+}
+
+// newMQTTPublish returns PUBLISH for a message on the topic, as the message
+// is passed around the broker in the form of an MQTT-SN PUBLISH. Only MQTT
+// 5.0 clients get the properties of the message.
+func newMQTTPublish(topic string, msg *PublishMessage, version byte) *mqttPacket {
+	var buf bytes.Buffer
+	writeMQTTString(&buf, []byte(topic))
+	if msg.Qos > 0 {
+		buf.Write(encodeUint16(msg.MessageId))
+	}
+	if version == 5 {
+		var props mqttPropertyWriter
+		msg.Properties.writeTo(&props, time.Now())
+		props.writeTo(&buf)
+	}
+	buf.Write(msg.Data)
+	flags := msg.Qos << 1
+	if msg.Retain {
+		flags |= 0x01
+	}
+	if msg.Dup {
+		flags |= 0x08
+	}
+	return &mqttPacket{Type: MQTT_PUBLISH, Flags: flags, Body: buf.Bytes()}
+}
+
+// mqttFilter is a topic filter of SUBSCRIBE with the requested subscription
+// options, which are just the QoS level before MQTT 5.0.
+type mqttFilter struct {
+	Topic   string
+	Options byte
+}
+
+type mqttSubscribe struct {
+	PacketId   uint16
+	Properties *mqttProperties
+	Filters    []mqttFilter
+}
+
+func parseMQTTSubscribe(p *mqttPacket, version byte) (*mqttSubscribe, error) {
+	if p.Flags != 0x02 {
+		return nil, errors.New("bad SUBSCRIBE flags")
+	}
+	r := &mqttReader{b: p.Body}
+	m := &mqttSubscribe{PacketId: r.uint16()}
+	if version == 5 {
+		m.Properties = r.properties()
+	}
+	reserved := byte(0xFC)
+	if version == 5 {
+		reserved = 0xC0
+	}
+	for r.err == nil && !r.empty() {
+		f := mqttFilter{Topic: r.string()}
+		options := r.byte()
+		if options&reserved != 0 || options&subQosBits > 2 || options&subRetainHandling == subRetainHandling {
+			return nil, errors.New("bad subscription options")
+		}
+		f.Options = options
+		m.Filters = append(m.Filters, f)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(m.Filters) == 0 {
+		return nil, errors.New("SUBSCRIBE without topic filters")
+	}
+	return m, nil
+}
+
+type mqttUnsubscribe struct {
+	PacketId   uint16
+	Properties *mqttProperties
+	Filters    []string
+}
+
+func parseMQTTUnsubscribe(p *mqttPacket, version byte) (*mqttUnsubscribe, error) {
+	if p.Flags != 0x02 {
+		return nil, errors.New("bad UNSUBSCRIBE flags")
+	}
+	r := &mqttReader{b: p.Body}
+	m := &mqttUnsubscribe{PacketId: r.uint16()}
+	if version == 5 {
+		m.Properties = r.properties()
+	}
+	for r.err == nil && !r.empty() {
+		m.Filters = append(m.Filters, r.string())
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(m.Filters) == 0 {
+		return nil, errors.New("UNSUBSCRIBE without topic filters")
+	}
+	return m, nil
+}
+
+// parseMQTTAck decodes the packet identifier and the reason code of PUBACK,
+// PUBREC, PUBREL or PUBCOMP.
+func parseMQTTAck(p *mqttPacket, version byte) (uint16, byte, error) {
+	r := &mqttReader{b: p.Body}
+	id := r.uint16()
+	var reason byte
+	if version == 5 && !r.empty() {
+		reason = r.byte()
+		if !r.empty() {
+			r.properties()
+		}
+	}
+	if r.err != nil || !r.empty() {
+		return 0, 0, errMalformed
+	}
+	return id, reason, nil
+}
+
+// newMQTTSuback returns SUBACK or UNSUBACK with a return or reason code for
+// every topic filter. MQTT 3.1.1 UNSUBACK carries no codes.
+func newMQTTSuback(packetType byte, packetId uint16, codes []byte, version byte) *mqttPacket {
+	var buf bytes.Buffer
+	buf.Write(encodeUint16(packetId))
+	if version == 5 {
+		buf.WriteByte(0)
+	}
+	if version == 5 || packetType == MQTT_SUBACK {
+		buf.Write(codes)
+	}
+	return &mqttPacket{Type: packetType, Body: buf.Bytes()}
+}
+
+// parseMQTTDisconnect decodes the reason code and properties of DISCONNECT
+// sent by an MQTT 5.0 client.
+func parseMQTTDisconnect(p *mqttPacket) (byte, *mqttProperties, error) {
+	r := &mqttReader{b: p.Body}
+	var reason byte
+	var props *mqttProperties
+	if !r.empty() {
+		reason = r.byte()
+	}
+	if !r.empty() {
+		props = r.properties()
+	}
+	if r.err != nil || !r.empty() {
+		return 0, nil, errMalformed
+	}
+	return reason, props, nil
+}
+
+func newMQTTDisconnect(reason byte) *mqttPacket {
+	return &mqttPacket{Type: MQTT_DISCONNECT, Body: []byte{reason}}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// MQTT 5.0 reason codes
+const (
+	MQTT_SUCCESS                   = 0x00
+	MQTT_DISCONNECT_WITH_WILL      = 0x04
+	MQTT_NO_MATCHING_SUBSCRIBERS   = 0x10
+	MQTT_NO_SUBSCRIPTION_EXISTED   = 0x11
+	MQTT_UNSPECIFIED_ERROR         = 0x80
+	MQTT_MALFORMED_PACKET          = 0x81
+	MQTT_PROTOCOL_ERROR            = 0x82
+	MQTT_UNSUPPORTED_VERSION       = 0x84
+	MQTT_CLIENT_ID_NOT_VALID       = 0x85
+	MQTT_NOT_AUTHORIZED            = 0x87
+	MQTT_SERVER_SHUTTING_DOWN      = 0x8B
+	MQTT_BAD_AUTHENTICATION_METHOD = 0x8C
+	MQTT_KEEP_ALIVE_TIMEOUT        = 0x8D
+	MQTT_SESSION_TAKEN_OVER        = 0x8E
+	MQTT_TOPIC_FILTER_INVALID      = 0x8F
+	MQTT_TOPIC_NAME_INVALID        = 0x90
+	MQTT_PACKET_ID_NOT_FOUND       = 0x92
+	MQTT_TOPIC_ALIAS_INVALID       = 0x94
+	MQTT_PACKET_TOO_LARGE          = 0x95
+)
+
+// MQTT 5.0 property identifiers
+const (
+	propPayloadFormat        = 0x01
+	propMessageExpiry        = 0x02
+	propContentType          = 0x03
+	propResponseTopic        = 0x08
+	propCorrelationData      = 0x09
+	propSubscriptionId       = 0x0B
+	propSessionExpiry        = 0x11
+	propAssignedClientId     = 0x12
+	propServerKeepAlive      = 0x13
+	propAuthMethod           = 0x15
+	propAuthData             = 0x16
+	propRequestProblemInfo   = 0x17
+	propWillDelay            = 0x18
+	propRequestResponseInfo  = 0x19
+	propResponseInfo         = 0x1A
+	propServerReference      = 0x1C
+	propReasonString         = 0x1F
+	propReceiveMaximum       = 0x21
+	propTopicAliasMaximum    = 0x22
+	propTopicAlias           = 0x23
+	propMaximumQos           = 0x24
+	propRetainAvailable      = 0x25
+	propUserProperty         = 0x26
+	propMaximumPacketSize    = 0x27
+	propWildcardAvailable    = 0x28
+	propSubscriptionIdsAvail = 0x29
+	propSharedAvailable      = 0x2A
+)
+
+// sessionNeverExpires is the session expiry interval of sessions that are
+// kept until the client cleans them.
+const sessionNeverExpires = 0xFFFFFFFF
+
+// mqttError is a protocol violation with the reason code to disconnect an
+// MQTT 5.0 client with.
+type mqttError struct {
+	code byte
+	msg  string
+}
+
+func (e *mqttError) Error() string {
+	return e.msg
+}
+
+// reasonCode returns the reason code to disconnect an MQTT 5.0 client with
+// after an error. Errors other than mqttError are malformed packets.
+func reasonCode(err error) byte {
+	if e, ok := err.(*mqttError); ok {
+		return e.code
+	}
+	return MQTT_MALFORMED_PACKET
+}
+
+type mqttUserProperty struct {
+	Key   string
+	Value string
+}
+
+// mqttProperties are the properties of an MQTT 5.0 packet. Only properties
+// listed in `has` were present.
+type mqttProperties struct {
+	has                 map[byte]bool
+	PayloadFormat       byte
+	MessageExpiry       uint32
+	ContentType         string
+	ResponseTopic       string
+	CorrelationData     []byte
+	SubscriptionIds     []uint32
+	SessionExpiry       uint32
+	AuthMethod          string
+	AuthData            []byte
+	RequestProblemInfo  byte
+	WillDelay           uint32
+	RequestResponseInfo byte
+	ReasonString        string
+	ReceiveMaximum      uint16
+	TopicAliasMaximum   uint16
+	TopicAlias          uint16
+	MaximumPacketSize   uint32
+	UserProperties      []mqttUserProperty
+}
+
+func (p *mqttProperties) present(id byte) bool {
+	return p != nil && p.has[id]
+}
+
+func (r *mqttReader) varint() uint32 {
+	var v uint32
+	for i := uint(0); ; i += 7 {
+		if i > 21 {
+			r.err = errMalformed
+			return 0
+		}
+		b := r.byte()
+		if r.err != nil {
+			return 0
+		}
+		v |= uint32(b&0x7F) << i
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+}
+
+func (r *mqttReader) uint32() uint32 {
+	if r.err != nil || len(r.b) < 4 {
+		r.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+// properties reads a property list. Properties may not repeat, except for
+// user properties and subscription identifiers.
+func (r *mqttReader) properties() *mqttProperties {
+	n := int(r.varint())
+	if r.err != nil || len(r.b) < n {
+		r.err = errMalformed
+		return nil
+	}
+	pr := &mqttReader{b: r.b[:n]}
+	r.b = r.b[n:]
+	p := &mqttProperties{has: make(map[byte]bool)}
+	for pr.err == nil && !pr.empty() {
+		id := byte(pr.varint())
+		if p.has[id] && id != propUserProperty && id != propSubscriptionId {
+			r.err = &mqttError{MQTT_PROTOCOL_ERROR, "repeated property"}
+			return nil
+		}
+		p.has[id] = true
+		switch id {
+		case propPayloadFormat:
+			p.PayloadFormat = pr.byte()
+		case propMessageExpiry:
+			p.MessageExpiry = pr.uint32()
+		case propContentType:
+			p.ContentType = pr.string()
+		case propResponseTopic:
+			p.ResponseTopic = pr.string()
+		case propCorrelationData:
+			p.CorrelationData = pr.bytes()
+		case propSubscriptionId:
+			p.SubscriptionIds = append(p.SubscriptionIds, pr.varint())
+		case propSessionExpiry:
+			p.SessionExpiry = pr.uint32()
+		case propAuthMethod:
+			p.AuthMethod = pr.string()
+		case propAuthData:
+			p.AuthData = pr.bytes()
+		case propRequestProblemInfo:
+			p.RequestProblemInfo = pr.byte()
+		case propWillDelay:
+			p.WillDelay = pr.uint32()
+		case propRequestResponseInfo:
+			p.RequestResponseInfo = pr.byte()
+		case propReasonString:
+			p.ReasonString = pr.string()
+		case propReceiveMaximum:
+			p.ReceiveMaximum = pr.uint16()
+		case propTopicAliasMaximum:
+			p.TopicAliasMaximum = pr.uint16()
+		case propTopicAlias:
+			p.TopicAlias = pr.uint16()
+		case propMaximumPacketSize:
+			p.MaximumPacketSize = pr.uint32()
+		case propUserProperty:
+			key := pr.string()
+			p.UserProperties = append(p.UserProperties, mqttUserProperty{key, pr.string()})
+		default:
+			r.err = &mqttError{MQTT_PROTOCOL_ERROR, "unexpected property"}
+			return nil
+		}
+	}
+	if pr.err != nil {
+		r.err = pr.err
+		return nil
+	}
+	return p
+}
+
+func writeVarint(buf *bytes.Buffer, n int) {
+	for {
+		b := byte(n & 0x7F)
+		n >>= 7
+		if n > 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if n == 0 {
+			return
+		}
+	}
+}
+
+// mqttPropertyWriter builds a property list.
+type mqttPropertyWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *mqttPropertyWriter) byte(id byte, v byte) {
+	w.buf.WriteByte(id)
+	w.buf.WriteByte(v)
+}
+
+func (w *mqttPropertyWriter) uint16(id byte, v uint16) {
+	w.buf.WriteByte(id)
+	w.buf.Write(encodeUint16(v))
+}
+
+func (w *mqttPropertyWriter) uint32(id byte, v uint32) {
+	w.buf.WriteByte(id)
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *mqttPropertyWriter) bytes(id byte, v []byte) {
+	w.buf.WriteByte(id)
+	writeMQTTString(&w.buf, v)
+}
+
+func (w *mqttPropertyWriter) userProperty(key, value string) {
+	w.buf.WriteByte(propUserProperty)
+	writeMQTTString(&w.buf, []byte(key))
+	writeMQTTString(&w.buf, []byte(value))
+}
+
+// writeTo appends the property list with its length to a packet body.
+func (w *mqttPropertyWriter) writeTo(buf *bytes.Buffer) {
+	writeVarint(buf, w.buf.Len())
+	buf.Write(w.buf.Bytes())
+}
+
+// messageProperties are the MQTT 5.0 properties of a published message that
+// are forwarded to subscribers. A nil value means no properties. Subscribers
+// using MQTT 3.1.1 or MQTT-SN get messages without them, but expired messages
+// are not delivered to anybody.
+type messageProperties struct {
+	PayloadFormat   byte
+	Expires         time.Time
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	UserProperties  []mqttUserProperty
+	// id of the client that published the message, for No Local
+	// subscriptions
+	origin string
+}
+
+// newMessageProperties returns the properties of a message published now
+// with the given PUBLISH or will properties, or nil if there are none that
+// are forwarded.
+func newMessageProperties(p *mqttProperties, origin string) *messageProperties {
+	if p == nil {
+		return nil
+	}
+	m := &messageProperties{
+		PayloadFormat:   p.PayloadFormat,
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		UserProperties:  p.UserProperties,
+		origin:          origin,
+	}
+	if p.present(propMessageExpiry) {
+		m.Expires = time.Now().Add(time.Duration(p.MessageExpiry) * time.Second)
+	}
+	return m
+}
+
+func (m *messageProperties) expired(now time.Time) bool {
+	return m != nil && !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// writeTo appends the properties of PUBLISH sent at the given time to w.
+func (m *messageProperties) writeTo(w *mqttPropertyWriter, now time.Time) {
+	if m == nil {
+		return
+	}
+	if m.PayloadFormat != 0 {
+		w.byte(propPayloadFormat, m.PayloadFormat)
+	}
+	if !m.Expires.IsZero() {
+		// The subscriber gets the time that is left, rounded up.
+		left := (m.Expires.Sub(now) + time.Second - 1) / time.Second
+		w.uint32(propMessageExpiry, uint32(left))
+	}
+	if m.ContentType != "" {
+		w.bytes(propContentType, []byte(m.ContentType))
+	}
+	if m.ResponseTopic != "" {
+		w.bytes(propResponseTopic, []byte(m.ResponseTopic))
+	}
+	if m.CorrelationData != nil {
+		w.bytes(propCorrelationData, m.CorrelationData)
+	}
+	for _, u := range m.UserProperties {
+		w.userProperty(u.Key, u.Value)
+	}
+}
+
+// validateMessageProperties checks the properties of PUBLISH or a will that
+// are forwarded with the message.
+func validateMessageProperties(p *mqttProperties) error {
+	if p.present(propResponseTopic) {
+		if err := validateMQTTTopicName(p.ResponseTopic); err != nil {
+			return &mqttError{MQTT_PROTOCOL_ERROR, "invalid response topic: " + err.Error()}
+		}
+	}
+	if p != nil && p.PayloadFormat > 1 {
+		return &mqttError{MQTT_PROTOCOL_ERROR, "invalid payload format indicator"}
+	}
+	return nil
+}
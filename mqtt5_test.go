@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRepeatedProperties(t *testing.T) {
+	user := join([]byte{propUserProperty}, mqttStr("k"), mqttStr("v"))
+	tests := []struct {
+		name  string
+		props []byte
+		ok    bool
+	}{
+		{"user properties", join(user, user), true},
+		{"subscription identifiers", []byte{propSubscriptionId, 1, propSubscriptionId, 2}, true},
+		{"session expiry", []byte{propSessionExpiry, 0, 0, 0, 1, propSessionExpiry, 0, 0, 0, 1}, false},
+		{"content type", join([]byte{propContentType}, mqttStr("a"), []byte{propContentType}, mqttStr("a")), false},
+		{"topic alias", []byte{propTopicAlias, 0, 1, propTopicAlias, 0, 2}, false},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		writeVarint(&buf, len(test.props))
+		buf.Write(test.props)
+		r := &mqttReader{b: buf.Bytes()}
+		p := r.properties()
+		if test.ok {
+			if r.err != nil || len(p.UserProperties)+len(p.SubscriptionIds) != 2 {
+				t.Errorf("%s: got %+v, %v", test.name, p, r.err)
+			}
+		} else if r.err == nil || reasonCode(r.err) != MQTT_PROTOCOL_ERROR {
+			t.Errorf("%s: got %v", test.name, r.err)
+		}
+	}
+}
+
+func TestMessageExpiryRounding(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		left time.Duration
+		want uint32
+	}{
+		{time.Nanosecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{10 * time.Second, 10},
+	}
+	for _, test := range tests {
+		var w mqttPropertyWriter
+		m := &messageProperties{Expires: now.Add(test.left)}
+		m.writeTo(&w, now)
+		var buf bytes.Buffer
+		w.writeTo(&buf)
+		r := &mqttReader{b: buf.Bytes()}
+		if p := r.properties(); r.err != nil || p.MessageExpiry != test.want {
+			t.Errorf("%v left: got %+v, %v, want %d", test.left, p, r.err, test.want)
+		}
+	}
+	if !(&messageProperties{Expires: now}).expired(now) {
+		t.Error("message not expired at its expiry")
+	}
+}
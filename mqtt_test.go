@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func mqttStr(s string) []byte {
+	var buf bytes.Buffer
+	writeMQTTString(&buf, []byte(s))
+	return buf.Bytes()
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestReadMQTTPacket(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 200)
+	tests := []struct {
+		name string
+		in   []byte
+		max  int
+		want *mqttPacket
+		err  error
+	}{
+		{"no body", []byte{0xC0, 0x00}, 2, &mqttPacket{Type: MQTT_PINGREQ, Body: []byte{}}, nil},
+		{"flags", []byte{0x62, 0x02, 0, 1}, 256, &mqttPacket{Type: MQTT_PUBREL, Flags: 0x02, Body: []byte{0, 1}}, nil},
+		{"two byte length", join([]byte{0x30, 0xC8, 0x01}, long), 203, &mqttPacket{Type: MQTT_PUBLISH, Body: long}, nil},
+		{"five byte length", []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}, mqttMaxLength + 5, nil, errMalformed},
+		{"too large", join([]byte{0x30, 0xC8, 0x01}, long), 202, nil, errTooLarge},
+		{"declared too large", []byte{0x10, 0xFF, 0xFF, 0xFF, 0x7F}, 1024, nil, errTooLarge},
+		{"nothing", []byte{}, 256, nil, io.EOF},
+		{"no length", []byte{0x30}, 256, nil, io.EOF},
+		{"truncated length", []byte{0x30, 0x80}, 256, nil, io.EOF},
+		{"truncated body", []byte{0x30, 0x05, 0, 1}, 256, nil, io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		p, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(test.in)), test.max)
+		if err != test.err || !reflect.DeepEqual(p, test.want) {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.name, p, err, test.want, test.err)
+		}
+	}
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152} {
+		var buf bytes.Buffer
+		in := &mqttPacket{Type: MQTT_PUBLISH, Flags: 0x0B, Body: make([]byte, n)}
+		if err := in.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		out, err := readMQTTPacket(bufio.NewReader(&buf), mqttMaxLength+5)
+		if err != nil || !reflect.DeepEqual(in, out) {
+			t.Errorf("length %d: got %v", n, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("length %d: %d bytes left", n, buf.Len())
+		}
+	}
+}
+
+func TestEncodeMQTT(t *testing.T) {
+	props := &mqttPropertyWriter{}
+	props.uint16(propTopicAliasMaximum, 10)
+	msg := NewPublishMessage(0, 0x00, []byte("x"), 1, 9, true, true)
+	tests := []struct {
+		name string
+		p    *mqttPacket
+		want []byte
+	}{
+		{"PUBACK", newMQTTAck(MQTT_PUBACK, 5, MQTT_SUCCESS), []byte{0x40, 2, 0, 5}},
+		{"PUBREC with reason", newMQTTAck(MQTT_PUBREC, 5, MQTT_NO_MATCHING_SUBSCRIBERS), []byte{0x50, 3, 0, 5, 0x10}},
+		{"PUBREL", newMQTTAck(MQTT_PUBREL, 5, MQTT_SUCCESS), []byte{0x62, 2, 0, 5}},
+		{"PUBCOMP", newMQTTAck(MQTT_PUBCOMP, 0x0102, MQTT_SUCCESS), []byte{0x70, 2, 1, 2}},
+		{"CONNACK", newMQTTConnack(true, MQTT_ACCEPTED, nil), []byte{0x20, 2, 1, 0}},
+		{"CONNACK refused", newMQTTConnack(false, MQTT_REJ_IDENTIFIER, nil), []byte{0x20, 2, 0, 2}},
+		{"CONNACK v5", newMQTTConnack(false, MQTT_ACCEPTED, props), []byte{0x20, 6, 0, 0, 3, propTopicAliasMaximum, 0, 10}},
+		{"PUBLISH", newMQTTPublish("/a", msg, 4), []byte{0x3B, 7, 0, 2, '/', 'a', 0, 9, 'x'}},
+		{"PUBLISH v5", newMQTTPublish("/a", msg, 5), []byte{0x3B, 8, 0, 2, '/', 'a', 0, 9, 0, 'x'}},
+		{"SUBACK", newMQTTSuback(MQTT_SUBACK, 3, []byte{0, 0x80}, 4), []byte{0x90, 4, 0, 3, 0, 0x80}},
+		{"SUBACK v5", newMQTTSuback(MQTT_SUBACK, 3, []byte{2}, 5), []byte{0x90, 4, 0, 3, 0, 2}},
+		{"UNSUBACK", newMQTTSuback(MQTT_UNSUBACK, 3, []byte{0}, 4), []byte{0xB0, 2, 0, 3}},
+		{"UNSUBACK v5", newMQTTSuback(MQTT_UNSUBACK, 3, []byte{0x11}, 5), []byte{0xB0, 4, 0, 3, 0, 0x11}},
+		{"DISCONNECT", newMQTTDisconnect(MQTT_SERVER_SHUTTING_DOWN), []byte{0xE0, 1, 0x8B}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := test.p.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, buf.Bytes(), test.want)
+		}
+	}
+}
+
+// mqttAck is what parseMQTTAck returns.
+type mqttAck struct {
+	id     uint16
+	reason byte
+}
+
+// decodeMQTT parses a packet sent by a client.
+func decodeMQTT(p *mqttPacket, version byte) (interface{}, error) {
+	switch p.Type {
+	case MQTT_CONNECT:
+		return parseMQTTConnect(p)
+	case MQTT_PUBLISH:
+		return parseMQTTPublish(p, version)
+	case MQTT_PUBACK, MQTT_PUBREC, MQTT_PUBREL, MQTT_PUBCOMP:
+		id, reason, err := parseMQTTAck(p, version)
+		if err != nil {
+			return nil, err
+		}
+		return mqttAck{id, reason}, nil
+	case MQTT_SUBSCRIBE:
+		return parseMQTTSubscribe(p, version)
+	case MQTT_UNSUBSCRIBE:
+		return parseMQTTUnsubscribe(p, version)
+	case MQTT_DISCONNECT:
+		reason, _, err := parseMQTTDisconnect(p)
+		if err != nil {
+			return nil, err
+		}
+		return reason, nil
+	}
+	return nil, nil
+}
+
+func TestDecodeMQTT(t *testing.T) {
+	user := "user"
+	sessionExpiry := []byte{5, propSessionExpiry, 0, 0, 0, 60}
+	contentType := join([]byte{6, propContentType}, mqttStr("a/b"))
+	tests := []struct {
+		name    string
+		p       *mqttPacket
+		version byte
+		want    interface{}
+	}{
+		// CONNECT
+		{"CONNECT", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{4, 0x02, 0, 30}, mqttStr("c1"))}, 0,
+			&mqttConnect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: true, KeepAlive: 30, ClientId: "c1"}},
+		{"CONNECT with will and credentials", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{4, 0xEE, 0, 10},
+			mqttStr("c2"), mqttStr("/will"), mqttStr("bye"), mqttStr("user"), mqttStr("pw"))}, 0,
+			&mqttConnect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: true, KeepAlive: 10, ClientId: "c2",
+				Will:     &Will{Topic: "/will", Qos: 1, Retain: true, Msg: []byte("bye")},
+				Username: &user, Password: []byte("pw")}},
+		{"CONNECT v5", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{5, 0, 0, 0}, sessionExpiry, mqttStr("c3"))}, 0,
+			&mqttConnect{ProtocolName: "MQTT", ProtocolLevel: 5, ClientId: "c3",
+				Properties: &mqttProperties{has: map[byte]bool{propSessionExpiry: true}, SessionExpiry: 60}}},
+		{"CONNECT of unsupported level", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{3, 0x02, 0, 30})}, 0,
+			&mqttConnect{ProtocolName: "MQTT", ProtocolLevel: 3, KeepAlive: 30}},
+		{"CONNECT of another protocol", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQIsdp"), []byte{3, 0x02, 0, 30}, mqttStr("c"))}, 0, nil},
+		{"CONNECT with reserved flag", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{4, 0x03, 0, 30}, mqttStr("c"))}, 0, nil},
+		{"CONNECT with will QoS 3", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{4, 0x1C, 0, 30},
+			mqttStr("c"), mqttStr("/will"), mqttStr("bye"))}, 0, nil},
+		{"CONNECT with will retain but no will", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{4, 0x20, 0, 30}, mqttStr("c"))}, 0, nil},
+		{"CONNECT with truncated client id", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{4, 0x02, 0, 30, 0, 5, 'c'})}, 0, nil},
+		{"CONNECT without password", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{4, 0x42, 0, 30}, mqttStr("c"))}, 0, nil},
+		{"CONNECT with invalid UTF-8", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{4, 0x02, 0, 30, 0, 2, 0xC3, 0x28})}, 0, nil},
+		{"CONNECT with U+0000", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{4, 0x02, 0, 30}, mqttStr("c\x00"))}, 0, nil},
+		{"CONNECT truncated", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{4, 0x02})}, 0, nil},
+		{"CONNECT v5 with repeated property", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{5, 0, 0, 0},
+			[]byte{10, propSessionExpiry, 0, 0, 0, 1, propSessionExpiry, 0, 0, 0, 2}, mqttStr("c"))}, 0, nil},
+		{"CONNECT v5 with server property", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{5, 0, 0, 0},
+			[]byte{4, propAssignedClientId, 0, 1, 'c'}, mqttStr("c"))}, 0, nil},
+		{"CONNECT v5 with truncated properties", &mqttPacket{Type: MQTT_CONNECT, Body: join(mqttStr("MQTT"), []byte{5, 0, 0, 0, 5, propSessionExpiry, 0})}, 0, nil},
+
+		// PUBLISH
+		{"PUBLISH", &mqttPacket{Type: MQTT_PUBLISH, Body: join(mqttStr("/a"), []byte("hi"))}, 4,
+			&mqttPublish{Topic: "/a", Payload: []byte("hi")}},
+		{"PUBLISH with QoS 1", &mqttPacket{Type: MQTT_PUBLISH, Flags: 0x0B, Body: join(mqttStr("/a"), []byte{0, 7, 'x'})}, 4,
+			&mqttPublish{Topic: "/a", PacketId: 7, Qos: 1, Retain: true, Dup: true, Payload: []byte("x")}},
+		{"PUBLISH v5", &mqttPacket{Type: MQTT_PUBLISH, Flags: 0x04, Body: join(mqttStr("/a"), []byte{0, 7}, contentType, []byte("x"))}, 5,
+			&mqttPublish{Topic: "/a", PacketId: 7, Qos: 2, Payload: []byte("x"),
+				Properties: &mqttProperties{has: map[byte]bool{propContentType: true}, ContentType: "a/b"}}},
+		{"PUBLISH with QoS 3", &mqttPacket{Type: MQTT_PUBLISH, Flags: 0x06, Body: join(mqttStr("/a"), []byte{0, 7, 'x'})}, 4, nil},
+		{"PUBLISH with packet identifier 0", &mqttPacket{Type: MQTT_PUBLISH, Flags: 0x02, Body: join(mqttStr("/a"), []byte{0, 0, 'x'})}, 4, nil},
+		{"PUBLISH with truncated topic", &mqttPacket{Type: MQTT_PUBLISH, Body: []byte{0, 5, '/', 'a'}}, 4, nil},
+		{"PUBLISH without packet identifier", &mqttPacket{Type: MQTT_PUBLISH, Flags: 0x02, Body: mqttStr("/a")}, 4, nil},
+		{"PUBLISH v5 without properties", &mqttPacket{Type: MQTT_PUBLISH, Body: mqttStr("/a")}, 5, nil},
+
+		// PUBACK, PUBREC, PUBREL and PUBCOMP
+		{"PUBACK", &mqttPacket{Type: MQTT_PUBACK, Body: []byte{0, 5}}, 4, mqttAck{5, 0}},
+		{"PUBREC v5", &mqttPacket{Type: MQTT_PUBREC, Body: []byte{0, 5, 0x10}}, 5, mqttAck{5, 0x10}},
+		{"PUBREL v5 with properties", &mqttPacket{Type: MQTT_PUBREL, Flags: 0x02, Body: []byte{0, 5, 0x92, 0}}, 5, mqttAck{5, 0x92}},
+		{"PUBCOMP with reason before 5.0", &mqttPacket{Type: MQTT_PUBCOMP, Body: []byte{0, 5, 0}}, 4, nil},
+		{"PUBACK truncated", &mqttPacket{Type: MQTT_PUBACK, Body: []byte{0}}, 4, nil},
+
+		// SUBSCRIBE and UNSUBSCRIBE
+		{"SUBSCRIBE", &mqttPacket{Type: MQTT_SUBSCRIBE, Flags: 0x02, Body: join([]byte{0, 1}, mqttStr("/a/#"), []byte{1}, mqttStr("/b"), []byte{0})}, 4,
+			&mqttSubscribe{PacketId: 1, Filters: []mqttFilter{{"/a/#", 1}, {"/b", 0}}}},
+		{"SUBSCRIBE v5", &mqttPacket{Type: MQTT_SUBSCRIBE, Flags: 0x02, Body: join([]byte{0, 2, 0}, mqttStr("/b"), []byte{0x2E})}, 5,
+			&mqttSubscribe{PacketId: 2, Properties: &mqttProperties{has: map[byte]bool{}}, Filters: []mqttFilter{{"/b", 0x2E}}}},
+		{"SUBSCRIBE with bad flags", &mqttPacket{Type: MQTT_SUBSCRIBE, Body: join([]byte{0, 1}, mqttStr("/a"), []byte{1})}, 4, nil},
+		{"SUBSCRIBE without filters", &mqttPacket{Type: MQTT_SUBSCRIBE, Flags: 0x02, Body: []byte{0, 1}}, 4, nil},
+		{"SUBSCRIBE with v5 options before 5.0", &mqttPacket{Type: MQTT_SUBSCRIBE, Flags: 0x02, Body: join([]byte{0, 1}, mqttStr("/a"), []byte{0x04})}, 4, nil},
+		{"SUBSCRIBE with QoS 3", &mqttPacket{Type: MQTT_SUBSCRIBE, Flags: 0x02, Body: join([]byte{0, 1}, mqttStr("/a"), []byte{3})}, 4, nil},
+		{"SUBSCRIBE with retain handling 3", &mqttPacket{Type: MQTT_SUBSCRIBE, Flags: 0x02, Body: join([]byte{0, 1, 0}, mqttStr("/a"), []byte{0x30})}, 5, nil},
+		{"SUBSCRIBE without options", &mqttPacket{Type: MQTT_SUBSCRIBE, Flags: 0x02, Body: join([]byte{0, 1}, mqttStr("/a"))}, 4, nil},
+		{"UNSUBSCRIBE", &mqttPacket{Type: MQTT_UNSUBSCRIBE, Flags: 0x02, Body: join([]byte{0, 1}, mqttStr("/a"), mqttStr("/b"))}, 4,
+			&mqttUnsubscribe{PacketId: 1, Filters: []string{"/a", "/b"}}},
+		{"UNSUBSCRIBE without filters", &mqttPacket{Type: MQTT_UNSUBSCRIBE, Flags: 0x02, Body: []byte{0, 1}}, 4, nil},
+		{"UNSUBSCRIBE with bad flags", &mqttPacket{Type: MQTT_UNSUBSCRIBE, Body: join([]byte{0, 1}, mqttStr("/a"))}, 4, nil},
+		{"UNSUBSCRIBE with truncated filter", &mqttPacket{Type: MQTT_UNSUBSCRIBE, Flags: 0x02, Body: []byte{0, 1, 0, 3, '/'}}, 4, nil},
+
+		// DISCONNECT
+		{"DISCONNECT", &mqttPacket{Type: MQTT_DISCONNECT}, 4, byte(0)},
+		{"DISCONNECT with will", &mqttPacket{Type: MQTT_DISCONNECT, Body: []byte{MQTT_DISCONNECT_WITH_WILL}}, 5, byte(MQTT_DISCONNECT_WITH_WILL)},
+		{"DISCONNECT with properties", &mqttPacket{Type: MQTT_DISCONNECT, Body: join([]byte{0}, sessionExpiry)}, 5, byte(0)},
+		{"DISCONNECT with truncated properties", &mqttPacket{Type: MQTT_DISCONNECT, Body: []byte{0, 5, propSessionExpiry}}, 5, nil},
+	}
+	for _, test := range tests {
+		got, err := decodeMQTT(test.p, test.version)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMQTTPublishRoundTrip(t *testing.T) {
+	msg := NewPublishMessage(0, 0x00, []byte("payload"), 2, 300, false, false)
+	msg.Properties = &messageProperties{ContentType: "text/plain", CorrelationData: []byte{1}}
+	for _, version := range []byte{4, 5} {
+		got, err := parseMQTTPublish(newMQTTPublish("/round/trip", msg, version), version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Topic != "/round/trip" || got.PacketId != 300 || got.Qos != 2 || string(got.Payload) != "payload" {
+			t.Errorf("version %d: got %+v", version, got)
+		}
+		if version == 5 && (got.Properties.ContentType != "text/plain" || !bytes.Equal(got.Properties.CorrelationData, []byte{1})) {
+			t.Errorf("got properties %+v", got.Properties)
+		}
+	}
+}
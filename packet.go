@@ -103,7 +103,9 @@ type Header struct {
 func (h *Header) unpack(b io.Reader) {
 	lengthCheck := readByte(b)
 	if lengthCheck == 0x01 {
-		h.Length = readUint16(b)
+		// Three-octet length field: normalize the length so it looks like it
+		// was encoded with a single octet, as pack() does the opposite.
+		h.Length = readUint16(b) - 2
 	} else {
 		h.Length = uint16(lengthCheck)
 	}
@@ -283,27 +285,46 @@ func encodeUint16(num uint16) []byte {
 	return bytes
 }
 
-// readString tries to read and validate a string as a byte array from the given buffer.
-func readString(b io.Reader) (buf []byte, err error) {
-	n, err := b.Read(buf)
-	if err != nil {
+// readString tries to read and validate a string of length n as a byte array
+// from the given buffer.
+func readString(b io.Reader, n int) (buf []byte, err error) {
+	if n < 0 {
+		return nil, errors.New("bad string length")
+	}
+	buf = make([]byte, n)
+	if _, err = io.ReadFull(b, buf); err != nil {
 		return
 	}
-	ok := utf8.Valid(buf)
-	if n < 2 || !ok {
-		err = errors.New("bad topic name")
+	if !utf8.Valid(buf) {
+		err = errors.New("bad string encoding")
 	}
 	return
 }
 
-func readTopic(b io.Reader) (buf []byte, err error) {
-	buf, err = readString(b)
-	if buf[0] != '/' {
+// readTopic reads a topic name, which must start with a slash. An empty topic
+// name is read without error, as it removes the will in WILLTOPIC.
+func readTopic(b io.Reader, n int) (buf []byte, err error) {
+	buf, err = readString(b, n)
+	if err != nil || len(buf) == 0 {
+		return
+	}
+	if len(buf) < 2 {
+		err = errors.New("bad topic name")
+	} else if buf[0] != '/' {
 		err = errors.New("topic name must start with a slash")
 	}
 	return
 }
 
+// readShortTopic reads a short topic name, which is exactly two characters
+// long and does not have to start with a slash.
+func readShortTopic(b io.Reader, n int) (buf []byte, err error) {
+	if n != 2 {
+		return nil, errors.New("short topic name must be two characters long")
+	}
+	return readString(b, n)
+}
+
 type AdvertiseMessage struct {
 	Header
 	GatewayId byte
@@ -522,7 +543,7 @@ func (wt *WillTopicMessage) Write(w io.Writer) (err error) {
 func (wt *WillTopicMessage) Unpack(b io.Reader) (err error) {
 	if wt.Header.Length > 2 {
 		wt.decodeFlags(readByte(b))
-		wt.WillTopic, err = readTopic(b)
+		wt.WillTopic, err = readTopic(b, int(wt.Header.Length)-3)
 	}
 	return
 }
@@ -567,7 +588,8 @@ func (wm *WillMsgMessage) Write(w io.Writer) (err error) {
 }
 
 func (wm *WillMsgMessage) Unpack(b io.Reader) (err error) {
-	_, err = b.Read(wm.WillMsg)
+	wm.WillMsg = make([]byte, wm.Header.Length-2)
+	_, err = io.ReadFull(b, wm.WillMsg)
 	return
 }
 
@@ -605,8 +627,7 @@ func (r *RegisterMessage) Write(w io.Writer) (err error) {
 func (r *RegisterMessage) Unpack(b io.Reader) (err error) {
 	r.TopicId = readUint16(b)
 	r.MessageId = readUint16(b)
-	r.TopicName = make([]byte, r.Header.Length-6)
-	r.TopicName, err = readTopic(b)
+	r.TopicName, err = readTopic(b, int(r.Header.Length)-6)
 	return
 }
 
@@ -648,6 +669,9 @@ type PublishMessage struct {
 	TopicId     uint16
 	MessageId   uint16
 	Data        []byte
+	// MQTT 5.0 properties that travel with the message through the broker,
+	// but are not sent over MQTT-SN.
+	Properties *messageProperties
 }
 
 func NewPublishMessage(TopicId uint16, TopicIdType byte, Data []byte, Qos byte, MessageId uint16, Retain bool, Dup bool) *PublishMessage {
@@ -862,9 +886,12 @@ func (s *SubscribeMessage) Unpack(b io.Reader) (err error) {
 	s.decodeFlags(readByte(b))
 	s.MessageId = readUint16(b)
 	switch s.TopicIdType {
-	case 0x00, 0x02:
-		s.TopicName = make([]byte, s.Header.Length-5)
-		s.TopicName, err = readTopic(b)
+	case 0x00:
+		// Topic filters are validated by the broker, as they do not have to
+		// start with a slash.
+		s.TopicName, err = readString(b, int(s.Header.Length)-5)
+	case 0x02:
+		s.TopicName, err = readShortTopic(b, int(s.Header.Length)-5)
 	case 0x01:
 		s.TopicId = readUint16(b)
 	}
@@ -970,8 +997,10 @@ func (u *UnsubscribeMessage) Unpack(b io.Reader) (err error) {
 	u.decodeFlags(readByte(b))
 	u.MessageId = readUint16(b)
 	switch u.TopicIdType {
-	case 0x00, 0x02:
-		u.TopicName, err = readTopic(b)
+	case 0x00:
+		u.TopicName, err = readString(b, int(u.Header.Length)-5)
+	case 0x02:
+		u.TopicName, err = readShortTopic(b, int(u.Header.Length)-5)
 	case 0x01:
 		u.TopicId = readUint16(b)
 	}
@@ -1024,7 +1053,7 @@ func (p *PingreqMessage) Write(w io.Writer) (err error) {
 
 func (p *PingreqMessage) Unpack(b io.Reader) (err error) {
 	if p.Header.Length > 2 {
-		p.ClientId, err = readTopic(b)
+		p.ClientId, err = readString(b, int(p.Header.Length)-2)
 	}
 	return
 }
@@ -1109,19 +1138,27 @@ func (wt *WillTopicUpdateMessage) decodeFlags(b byte) {
 }
 
 func (wt *WillTopicUpdateMessage) Write(w io.Writer) (err error) {
-	wt.Header.Length = uint16(len(wt.WillTopic) + 3)
+	if len(wt.WillTopic) == 0 {
+		wt.Header.Length = 2
+	} else {
+		wt.Header.Length = uint16(len(wt.WillTopic) + 3)
+	}
 	packet := wt.Header.pack()
 	packet.WriteByte(WILLTOPICUPD)
-	packet.WriteByte(wt.encodeFlags())
-	packet.Write(wt.WillTopic)
+	if wt.Header.Length > 2 {
+		packet.WriteByte(wt.encodeFlags())
+		packet.Write(wt.WillTopic)
+	}
 	_, err = packet.WriteTo(w)
 
 	return
 }
 
 func (wt *WillTopicUpdateMessage) Unpack(b io.Reader) (err error) {
-	wt.decodeFlags(readByte(b))
-	wt.WillTopic, err = readTopic(b)
+	if wt.Header.Length > 2 {
+		wt.decodeFlags(readByte(b))
+		wt.WillTopic, err = readTopic(b, int(wt.Header.Length)-3)
+	}
 	return
 }
 
@@ -1168,7 +1205,8 @@ func (wm *WillMsgUpdateMessage) Write(w io.Writer) (err error) {
 }
 
 func (wm *WillMsgUpdateMessage) Unpack(b io.Reader) (err error) {
-	_, err = b.Read(wm.WillMsg)
+	wm.WillMsg = make([]byte, wm.Header.Length-2)
+	_, err = io.ReadFull(b, wm.WillMsg)
 	return
 }
 
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// inflightMessage is a message sent to a client with QoS > 0 that was not
+// acknowledged yet. QoS 2 messages are released once the client confirms
+// them with PUBREC, and then wait for PUBCOMP.
+type inflightMessage struct {
+	topic    string
+	msg      *PublishMessage
+	sent     time.Time
+	retries  int
+	released bool
+}
+
+// allocateMessageId returns a message ID that is not in flight, or 0 if there
+// is none left. The caller must hold the lock.
+func (c *Client) allocateMessageId() uint16 {
+	// Message ID 0x0000 is reserved, and IDs in flight may not be reused.
+	for i := 0; i < 0x10000; i++ {
+		c.nextMessageId++
+		if c.nextMessageId == 0 {
+			continue
+		}
+		if _, ok := c.inflight[c.nextMessageId]; ok {
+			continue
+		}
+		if _, ok := c.registrations[c.nextMessageId]; !ok {
+			return c.nextMessageId
+		}
+	}
+	return 0
+}
+
+// Inflight returns copies of all messages in flight, with PUBLISH marked as
+// duplicates.
+func (c *Client) Inflight() []inflightMessage {
+	defer c.RUnlock()
+	c.RLock()
+	list := make([]inflightMessage, 0, len(c.inflight))
+	for _, m := range c.inflight {
+		dup := *m.msg
+		dup.Dup = true
+		list = append(list, inflightMessage{topic: m.topic, msg: &dup, released: m.released})
+	}
+	return list
+}
+
+// Confirm releases a QoS 2 message in flight after PUBREC. It returns false if
+// there was no QoS 2 message with such ID.
+func (c *Client) Confirm(messageId uint16) bool {
+	defer c.Unlock()
+	c.Lock()
+	m, ok := c.inflight[messageId]
+	if !ok || m.msg.Qos != 2 {
+		return false
+	}
+	if !m.released {
+		m.released = true
+		m.sent = time.Now()
+		m.retries = 0
+		c.dirty = true
+	}
+	return true
+}
+
+// Acknowledge forgets a message in flight after PUBACK or PUBCOMP. It returns
+// false if there was no message with such ID.
+func (c *Client) Acknowledge(messageId uint16) bool {
+	defer c.Unlock()
+	c.Lock()
+	_, ok := c.inflight[messageId]
+	delete(c.inflight, messageId)
+	c.dirty = c.dirty || ok
+	return ok
+}
+
+// Unacknowledged returns messages to retransmit for everything in flight
+// that was sent before `now - interval`: copies of PUBLISH marked as
+// duplicates, or PUBREL for released messages. Messages that were
+// retransmitted `max` times already are forgotten and their IDs returned.
+func (c *Client) Unacknowledged(now time.Time, interval time.Duration, max int) (resend []Message, dropped []uint16) {
+	defer c.Unlock()
+	c.Lock()
+	for id, m := range c.inflight {
+		if now.Sub(m.sent) < interval {
+			continue
+		}
+		if m.retries >= max {
+			delete(c.inflight, id)
+			dropped = append(dropped, id)
+			c.dirty = true
+			continue
+		}
+		m.retries++
+		m.sent = now
+		if m.released {
+			rel := NewMessage(PUBREL).(*PubrelMessage)
+			rel.MessageId = id
+			resend = append(resend, rel)
+			continue
+		}
+		dup := *m.msg
+		dup.Dup = true
+		resend = append(resend, &dup)
+	}
+	for id, r := range c.registrations {
+		if now.Sub(r.sent) < interval {
+			continue
+		}
+		if r.retries >= max {
+			delete(c.registrations, id)
+			dropped = append(dropped, id)
+			continue
+		}
+		r.retries++
+		r.sent = now
+		resend = append(resend, NewRegisterMessage(r.topicId, id, []byte(r.topic)))
+	}
+	return
+}
+
+// Receive remembers the ID of a QoS 2 message received from the client. It
+// returns false if the message was received before and is not released yet.
+func (c *Client) Receive(messageId uint16) bool {
+	defer c.Unlock()
+	c.Lock()
+	if c.received[messageId] {
+		return false
+	}
+	c.received[messageId] = true
+	c.dirty = true
+	return true
+}
+
+// Release forgets the ID of a QoS 2 message received from the client after
+// PUBREL.
+func (c *Client) Release(messageId uint16) {
+	defer c.Unlock()
+	c.Lock()
+	delete(c.received, messageId)
+	c.dirty = true
+}
+
+// send writes a message on the topic to the client, tracking it if its QoS
+// requires an acknowledgement. Such messages are queued instead while the
+// client has too many of them in flight.
+func send(c *Client, topic string, p *PublishMessage) {
+	max := serv.Config.QoS.MaxInflight
+	if max <= 0 {
+		max = 0xFFFF
+	}
+	if p.Qos > 0 && !c.TrackWithin(topic, p, max) {
+		return
+	}
+	if err := c.Write(p); err != nil {
+		log.Println(err)
+	}
+}
+
+// Retransmit checks every `d` for messages that clients did not acknowledge
+// in time and sends them again.
+func Retransmit(d time.Duration) {
+	for {
+		time.Sleep(d)
+		interval := time.Duration(serv.Config.QoS.RetryInterval) * time.Second
+		now := time.Now()
+		for _, client := range clients.List() {
+			// MQTT clients get messages in flight again only when they
+			// reconnect.
+			if client.State() != stateActive || client.Stream() != nil {
+				continue
+			}
+			retransmit(client, now, interval)
+		}
+	}
+}
+
+// retransmit sends everything in flight to the client again that was sent
+// before `now - interval`.
+func retransmit(c *Client, now time.Time, interval time.Duration) {
+	resend, dropped := c.Unacknowledged(now, interval, serv.Config.QoS.MaxRetries)
+	for _, id := range dropped {
+		log.Println("Giving up on message", id, "to", c)
+	}
+	for _, m := range resend {
+		if err := c.Write(m); err != nil {
+			log.Println(err)
+		}
+	}
+	if len(dropped) > 0 {
+		// Messages may be waiting for the IDs given up.
+		deliverQueued(c)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageIdsExhausted(t *testing.T) {
+	c := NewClient("exhausted", nil, nil)
+	for id := 1; id < 0x10000; id++ {
+		c.inflight[uint16(id)] = &inflightMessage{}
+	}
+	p := NewPublishMessage(0, 0x00, []byte("x"), 1, 0, false, false)
+	if c.TrackWithin("/exhausted", p, 0x10000) {
+		t.Fatal("message tracked without a free message ID")
+	}
+	if len(c.queue.messages) != 1 {
+		t.Fatal("message not queued")
+	}
+	if topicId, _, _ := c.StartRegistration(1, "/exhausted", p); topicId != 0 {
+		t.Fatal("registration started without a free message ID")
+	}
+
+	c.Acknowledge(42)
+	if id := c.allocateMessageId(); id != 42 {
+		t.Fatal("expected message ID 42, got", id)
+	}
+}
+
+func TestMaxInflight(t *testing.T) {
+	sub := dialSN(t)
+	sub.connect("inflight-sub", true)
+	sub.subscribe("/inflight", 1)
+
+	pub := dialSN(t)
+	pub.connect("inflight-pub", true)
+	id := pub.register("/inflight")
+	for _, data := range []string{"1", "2", "3"} {
+		pub.publish(id, 1, data)
+		if _, ok := pub.recv().(*PubackMessage); !ok {
+			t.Fatal("expected PUBACK")
+		}
+	}
+
+	// MaxInflight is 2 in tests.
+	first := sub.receivePublish()
+	second := sub.receivePublish()
+	if string(first.Data) != "1" || string(second.Data) != "2" {
+		t.Fatalf("got %q and %q", first.Data, second.Data)
+	}
+	sub.expectNone()
+
+	ack := NewMessage(PUBACK).(*PubackMessage)
+	ack.TopicId = first.TopicId
+	ack.MessageId = first.MessageId
+	ack.ReturnCode = ACCEPTED
+	sub.send(ack)
+	if p := sub.receivePublish(); string(p.Data) != "3" {
+		t.Fatalf("got %q", p.Data)
+	}
+}
+
+func TestQos2FromClient(t *testing.T) {
+	sub := dialSN(t)
+	sub.connect("qos2-in-sub", true)
+	sub.subscribe("/qos2/in", 0)
+	pub := dialSN(t)
+	pub.connect("qos2-in-pub", true)
+	id := pub.register("/qos2/in")
+
+	expectPubrec := func() {
+		t.Helper()
+		if rec, ok := pub.recv().(*PubrecMessage); !ok || rec.MessageId != 5 {
+			t.Fatalf("expected PUBREC, got %#v", rec)
+		}
+	}
+	pub.send(NewPublishMessage(id, 0x00, []byte("once"), 2, 5, false, false))
+	expectPubrec()
+	if p := sub.receivePublish(); string(p.Data) != "once" {
+		t.Fatalf("got %q", p.Data)
+	}
+	// A retransmission before PUBREL is acknowledged, but not forwarded.
+	pub.send(NewPublishMessage(id, 0x00, []byte("once"), 2, 5, false, true))
+	expectPubrec()
+	sub.expectNone()
+
+	rel := NewMessage(PUBREL).(*PubrelMessage)
+	rel.MessageId = 5
+	pub.send(rel)
+	if comp, ok := pub.recv().(*PubcompMessage); !ok || comp.MessageId != 5 {
+		t.Fatalf("expected PUBCOMP, got %#v", comp)
+	}
+	// The message ID is free again.
+	pub.send(NewPublishMessage(id, 0x00, []byte("twice"), 2, 5, false, false))
+	expectPubrec()
+	if p := sub.receivePublish(); string(p.Data) != "twice" {
+		t.Fatalf("got %q", p.Data)
+	}
+}
+
+func TestQos2ToClient(t *testing.T) {
+	sub := dialSN(t)
+	sub.connect("qos2-out-sub", true)
+	sub.subscribe("/qos2/out", 2)
+	pub := dialSN(t)
+	pub.connect("qos2-out-pub", true)
+	pub.publish(pub.register("/qos2/out"), 2, "exactly once")
+
+	p := sub.receivePublish()
+	if p.Qos != 2 || string(p.Data) != "exactly once" {
+		t.Fatalf("got %#v", p)
+	}
+	rec := NewMessage(PUBREC).(*PubrecMessage)
+	rec.MessageId = p.MessageId
+	sub.send(rec)
+	if rel, ok := sub.recv().(*PubrelMessage); !ok || rel.MessageId != p.MessageId {
+		t.Fatalf("expected PUBREL, got %#v", rel)
+	}
+	// Without PUBCOMP, PUBREL is sent again instead of PUBLISH.
+	if rel, ok := sub.read(3 * time.Second).(*PubrelMessage); !ok || rel.MessageId != p.MessageId {
+		t.Fatalf("expected PUBREL again, got %#v", rel)
+	}
+
+	comp := NewMessage(PUBCOMP).(*PubcompMessage)
+	comp.MessageId = p.MessageId
+	sub.send(comp)
+	if n := len(clients.GetClientById("qos2-out-sub").Inflight()); n != 0 {
+		t.Fatal(n, "messages still in flight")
+	}
+	if m := sub.read(2 * time.Second); m != nil {
+		t.Fatalf("unexpected %#v", m)
+	}
+}
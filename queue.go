@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// queuedMessage is a message kept for a client that cannot receive it right
+// now. Its topic is resolved to a topic ID only when it is delivered.
+type queuedMessage struct {
+	topic  string
+	msg    *PublishMessage
+	queued time.Time
+}
+
+// messageQueue keeps messages for a sleeping or disconnected client within
+// the limits of the [Queue] section of the config.
+type messageQueue struct {
+	messages []queuedMessage
+	size     int
+}
+
+func (q *messageQueue) dropOldest() {
+	q.size -= len(q.messages[0].msg.Data)
+	q.messages = q.messages[1:]
+}
+
+// expire drops messages that stayed in the queue for too long.
+func (q *messageQueue) expire(now time.Time) {
+	maxAge := time.Duration(serv.Config.Queue.MaxAge) * time.Second
+	for maxAge > 0 && len(q.messages) > 0 && now.Sub(q.messages[0].queued) > maxAge {
+		q.dropOldest()
+	}
+}
+
+// full reports whether a message of the given size does not fit in the queue.
+func (q *messageQueue) full(size int) bool {
+	limits := serv.Config.Queue
+	return (limits.MaxMessages > 0 && len(q.messages)+1 > limits.MaxMessages) ||
+		(limits.MaxBytes > 0 && q.size+size > limits.MaxBytes)
+}
+
+// push adds a message to the queue, dropping the oldest ones or rejecting
+// the new one if the queue is full. It returns false if the message was
+// rejected.
+func (q *messageQueue) push(topic string, p *PublishMessage) bool {
+	now := time.Now()
+	q.expire(now)
+	size := len(p.Data)
+	if serv.Config.Queue.MaxBytes > 0 && size > serv.Config.Queue.MaxBytes {
+		return false
+	}
+	for q.full(size) {
+		if serv.Config.Queue.DropPolicy == "new" || len(q.messages) == 0 {
+			return false
+		}
+		q.dropOldest()
+	}
+	q.messages = append(q.messages, queuedMessage{topic, p, now})
+	q.size += size
+	return true
+}
+
+// Hold queues a message on the topic for delivery once the client wakes up
+// or connects again. Messages with QoS 0 are only kept for sleeping clients
+// and are dropped for disconnected ones. It returns false without doing
+// anything if the client can receive the message right away.
+func (c *Client) Hold(topic string, p *PublishMessage) bool {
+	defer c.Unlock()
+	c.Lock()
+	switch c.state {
+	case stateAsleep:
+	case stateLost, stateDisconnected:
+		if p.Qos == 0 {
+			return true
+		}
+	default:
+		return false
+	}
+	if !c.queue.push(topic, p) {
+		log.Println("Queue of", c.ClientId, "is full, dropping message on", topic)
+	}
+	c.dirty = true
+	return true
+}
+
+// TrackWithin assigns a free message ID to the message on the topic and keeps
+// it until Acknowledge is called with that ID, unless the client already has
+// max messages in flight, older ones waiting for room or no free message ID.
+// The message is queued then, and false is returned.
+func (c *Client) TrackWithin(topic string, p *PublishMessage, max int) bool {
+	defer c.Unlock()
+	c.Lock()
+	var id uint16
+	if len(c.inflight) < max && len(c.queue.messages) == 0 {
+		id = c.allocateMessageId()
+	}
+	if id == 0 {
+		if !c.queue.push(topic, p) {
+			log.Println("Queue of", c.ClientId, "is full, dropping message on", topic)
+		}
+		c.dirty = true
+		return false
+	}
+	p.MessageId = id
+	stored := *p
+	c.inflight[p.MessageId] = &inflightMessage{topic: topic, msg: &stored, sent: time.Now()}
+	c.dirty = true
+	return true
+}
+
+// FetchQueued returns and forgets all messages queued for the client, in
+// order.
+func (c *Client) FetchQueued() []queuedMessage {
+	defer c.Unlock()
+	c.Lock()
+	c.queue.expire(time.Now())
+	messages := c.queue.messages
+	c.queue = messageQueue{}
+	c.dirty = c.dirty || len(messages) > 0
+	return messages
+}
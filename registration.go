@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+)
+
+// registration is a topic registration initiated by the broker. Messages on
+// the topic are queued until the client acknowledges it with REGACK.
+type registration struct {
+	topicId uint16
+	topic   string
+	queue   []*PublishMessage
+	sent    time.Time
+	retries int
+}
+
+// StartRegistration queues a message until the topic is registered with the
+// client and gives the message the topic ID. With per-client topic IDs, topic
+// ID 0 is replaced by one from the client's own topic ID space. It returns
+// the topic ID and the message ID for a new REGISTER to send, or 0 if the
+// registration is already in progress. If the topic was registered meanwhile
+// or there is no topic ID or message ID for it, the message is not queued and
+// false is returned.
+func (c *Client) StartRegistration(topicId uint16, topic string, p *PublishMessage) (uint16, uint16, bool) {
+	defer c.Unlock()
+	c.Lock()
+	if id, ok := c.registeredIds[topic]; ok {
+		p.TopicId = id
+		return id, 0, false
+	}
+	for _, r := range c.registrations {
+		if r.topic == topic {
+			p.TopicId = r.topicId
+			r.queue = append(r.queue, p)
+			return r.topicId, 0, true
+		}
+	}
+	if topicId == 0 && serv.Config.Topics.PerClientIds {
+		topicId = c.allocateTopicId()
+	}
+	if topicId == 0 {
+		return 0, 0, false
+	}
+	messageId := c.allocateMessageId()
+	if messageId == 0 {
+		return 0, 0, false
+	}
+	p.TopicId = topicId
+	c.registrations[messageId] = &registration{
+		topicId: topicId,
+		topic:   topic,
+		queue:   []*PublishMessage{p},
+		sent:    time.Now(),
+	}
+	return topicId, messageId, true
+}
+
+// FinishRegistration completes the registration with the given message ID
+// and returns the messages queued meanwhile. The topic is registered with
+// the client only if it was accepted. It returns false if there was no such
+// registration.
+func (c *Client) FinishRegistration(messageId uint16, accepted bool) ([]*PublishMessage, bool) {
+	defer c.Unlock()
+	c.Lock()
+	r, ok := c.registrations[messageId]
+	if !ok {
+		return nil, false
+	}
+	delete(c.registrations, messageId)
+	if accepted {
+		c.registeredTopics[r.topicId] = r.topic
+		c.registeredIds[r.topic] = r.topicId
+		c.dirty = true
+	}
+	return r.queue, true
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retainedMessages keeps the last retained message published on every topic,
+// indexed by the levels of the topic like subscriptionTree, so that a new
+// subscription only visits the topics its filter can match.
+type retainedMessages struct {
+	sync.RWMutex
+	root *retainedNode
+}
+
+type retainedNode struct {
+	children map[string]*retainedNode
+	// the message retained on the topic ending at this node, if any
+	topic string
+	msg   *PublishMessage
+}
+
+func newRetainedNode() *retainedNode {
+	return &retainedNode{children: make(map[string]*retainedNode)}
+}
+
+// O(levels)
+func (repo *retainedMessages) store(topic string, msg *PublishMessage) {
+	defer repo.Unlock()
+	repo.Lock()
+	// A retained message with an empty payload clears the topic.
+	if len(msg.Data) == 0 {
+		repo.remove(topic)
+		if err := store.DeleteRetained(topic); err != nil {
+			log.Println("Unable to store retained message on", topic, ":", err)
+		}
+		return
+	}
+	kept := NewPublishMessage(0, 0x00, msg.Data, msg.Qos, 0, true, false)
+	kept.Properties = msg.Properties
+	repo.put(topic, kept)
+	if err := store.PutRetained(topic, msg); err != nil {
+		log.Println("Unable to store retained message on", topic, ":", err)
+	}
+}
+
+// O(levels)
+func (repo *retainedMessages) restore(topic string, msg *PublishMessage) {
+	defer repo.Unlock()
+	repo.Lock()
+	repo.put(topic, msg)
+}
+
+// put keeps the message on the topic. The caller must hold the lock.
+func (repo *retainedMessages) put(topic string, msg *PublishMessage) {
+	node := repo.root
+	for _, level := range strings.Split(topic, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newRetainedNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.topic = topic
+	node.msg = msg
+}
+
+// remove forgets the message on the topic, pruning nodes that are no longer
+// used. The caller must hold the lock.
+func (repo *retainedMessages) remove(topic string) {
+	levels := strings.Split(topic, "/")
+	path := make([]*retainedNode, 0, len(levels)+1)
+	node := repo.root
+	path = append(path, node)
+	for _, level := range levels {
+		node = node.children[level]
+		if node == nil {
+			return
+		}
+		path = append(path, node)
+	}
+	node.msg = nil
+	for i := len(levels); i > 0; i-- {
+		n := path[i]
+		if n.msg != nil || len(n.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, levels[i-1])
+	}
+}
+
+// match returns the retained messages that did not expire on topics
+// matching the filter.
+func (repo *retainedMessages) match(filter string) map[string]*PublishMessage {
+	defer repo.RUnlock()
+	repo.RLock()
+	matched := make(map[string]*PublishMessage)
+	repo.root.match(strings.Split(filter, "/"), true, time.Now(), matched)
+	return matched
+}
+
+// match adds the messages below the node that match the filter levels.
+// Wildcards at the first level do not match topics beginning with '$'.
+func (n *retainedNode) match(levels []string, first bool, now time.Time, matched map[string]*PublishMessage) {
+	if len(levels) == 0 {
+		n.add(now, matched)
+		return
+	}
+	switch levels[0] {
+	case "#":
+		// A multi-level wildcard also matches the parent level.
+		n.collect(first, now, matched)
+	case "+":
+		for level, child := range n.children {
+			if !first || !strings.HasPrefix(level, "$") {
+				child.match(levels[1:], false, now, matched)
+			}
+		}
+	default:
+		if child := n.children[levels[0]]; child != nil {
+			child.match(levels[1:], false, now, matched)
+		}
+	}
+}
+
+// collect adds the messages at and below the node, skipping topics beginning
+// with '$' below it if told so.
+func (n *retainedNode) collect(skipDollar bool, now time.Time, matched map[string]*PublishMessage) {
+	n.add(now, matched)
+	for level, child := range n.children {
+		if !skipDollar || !strings.HasPrefix(level, "$") {
+			child.collect(false, now, matched)
+		}
+	}
+}
+
+func (n *retainedNode) add(now time.Time, matched map[string]*PublishMessage) {
+	if n.msg != nil && !n.msg.Properties.expired(now) {
+		matched[n.topic] = n.msg
+	}
+}
+
+// deliverRetained sends retained messages matching a new subscription to the
+// client. Shared subscriptions do not get retained messages.
+func deliverRetained(c *Client, filter string, qos byte) {
+	if _, _, shared := sharedFilter(filter); shared {
+		return
+	}
+	for topic, msg := range retained.match(filter) {
+		q := qos
+		if msg.Qos < q {
+			q = msg.Qos
+		}
+		p := NewPublishMessage(0, 0x00, msg.Data, q, 0, true, false)
+		p.Properties = msg.Properties
+		deliver(c, topic, p)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRetainedMatch(t *testing.T) {
+	repo := retainedMessages{root: newRetainedNode()}
+	topics := []string{"/a", "/a/b", "/a/b/c", "/a/x/c", "/b", "$SYS/uptime", "$SYS/load/1"}
+	for _, topic := range topics {
+		repo.store(topic, NewPublishMessage(0, 0x00, []byte(topic), 0, 0, true, false))
+	}
+	expired := NewPublishMessage(0, 0x00, []byte("old"), 0, 0, true, false)
+	expired.Properties = &messageProperties{Expires: time.Now().Add(-time.Second)}
+	repo.store("/a/expired", expired)
+
+	tests := []struct {
+		filter string
+		topics []string
+	}{
+		{"/a/b", []string{"/a/b"}},
+		{"/a/+", []string{"/a/b"}},
+		{"/a/+/c", []string{"/a/b/c", "/a/x/c"}},
+		{"/a/#", []string{"/a", "/a/b", "/a/b/c", "/a/x/c"}},
+		{"/c/#", nil},
+		{"#", []string{"/a", "/a/b", "/a/b/c", "/a/x/c", "/b"}},
+		{"+/+", []string{"/a", "/b"}},
+		{"$SYS/#", []string{"$SYS/load/1", "$SYS/uptime"}},
+		{"$SYS/+", []string{"$SYS/uptime"}},
+		{"+/uptime", nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for topic, msg := range repo.match(test.filter) {
+			if string(msg.Data) != topic {
+				t.Errorf("%s: message of %s on %s", test.filter, msg.Data, topic)
+			}
+			got = append(got, topic)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.topics) {
+			t.Errorf("%s: got %v, want %v", test.filter, got, test.topics)
+		}
+	}
+
+	// Clearing every topic leaves nothing behind.
+	for _, topic := range append(topics, "/a/expired") {
+		repo.store(topic, NewPublishMessage(0, 0x00, nil, 0, 0, true, false))
+	}
+	if len(repo.root.children) != 0 {
+		t.Errorf("nodes left after clearing: %v", repo.root.children)
+	}
+}
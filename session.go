@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Sessions keeps clients that disconnected without asking for a clean
+// session, so that they get their subscriptions, registered topics and
+// messages in flight back once they connect again.
+type Sessions struct {
+	sync.RWMutex
+	// indexed by client id
+	sessions map[string]*Client
+	// client ids with a session in the storage
+	stored map[string]bool
+	// set once the storage is closed
+	closed bool
+}
+
+// Save keeps the session of a disconnected client.
+func (s *Sessions) Save(c *Client) {
+	defer s.Unlock()
+	s.Lock()
+	s.sessions[c.ClientId] = c
+	s.put(c)
+}
+
+// Store writes the session of a connected client with a persistent session
+// or of a saved session to the storage, if it changed since it was last
+// written. Clients that left or were taken over meanwhile are skipped.
+func (s *Sessions) Store(c *Client) {
+	defer s.Unlock()
+	s.Lock()
+	if !c.Dirty() || c.CleanSession() {
+		return
+	}
+	if s.sessions[c.ClientId] != c && clients.GetClientById(c.ClientId) != c {
+		return
+	}
+	s.put(c)
+}
+
+// put writes the session of a client to the storage. The caller must hold
+// the lock.
+func (s *Sessions) put(c *Client) {
+	if s.closed {
+		return
+	}
+	if err := store.PutSession(c.Snapshot()); err != nil {
+		log.Println("Unable to store session of", c, ":", err)
+		return
+	}
+	s.stored[c.ClientId] = true
+}
+
+// Take returns and forgets the saved session of a client, or nil if there is
+// none. The session stays in the storage while the client is connected, and
+// Checkpoint keeps it up to date there, so that it survives a crash.
+func (s *Sessions) Take(clientId string) *Client {
+	defer s.Unlock()
+	s.Lock()
+	c := s.sessions[clientId]
+	delete(s.sessions, clientId)
+	return c
+}
+
+// Get returns the saved session of a client, or nil if there is none.
+func (s *Sessions) Get(clientId string) *Client {
+	defer s.RUnlock()
+	s.RLock()
+	return s.sessions[clientId]
+}
+
+// List returns a snapshot of all saved sessions.
+func (s *Sessions) List() []*Client {
+	defer s.RUnlock()
+	s.RLock()
+	list := make([]*Client, 0, len(s.sessions))
+	for _, client := range s.sessions {
+		list = append(list, client)
+	}
+	return list
+}
+
+// Remove drops the saved session of a client and its copy in the storage, if
+// there is any.
+func (s *Sessions) Remove(clientId string) {
+	defer s.Unlock()
+	s.Lock()
+	if c, ok := s.sessions[clientId]; ok {
+		delete(s.sessions, clientId)
+		c.Free()
+	}
+	if !s.stored[clientId] || s.closed {
+		return
+	}
+	delete(s.stored, clientId)
+	if err := store.DeleteSession(clientId); err != nil {
+		log.Println("Unable to remove session of", clientId, ":", err)
+	}
+}
+
+// Close writes all sessions that changed to the storage for the last time.
+// Nothing is written after it returns, so that the storage may be closed.
+func (s *Sessions) Close() {
+	defer s.Unlock()
+	s.Lock()
+	for _, c := range clients.List() {
+		if c.Dirty() && !c.CleanSession() {
+			s.put(c)
+		}
+	}
+	for _, c := range s.sessions {
+		if c.Dirty() {
+			s.put(c)
+		}
+	}
+	s.closed = true
+}
+
+// Checkpoint writes every `d` the persistent sessions that changed to the
+// storage, so that a crash loses at most what happened during the last `d`.
+func Checkpoint(d time.Duration) {
+	for {
+		time.Sleep(d)
+		for _, client := range append(clients.List(), sessions.List()...) {
+			sessions.Store(client)
+		}
+	}
+}
+
+// leave removes a client that is gone from the list of connected clients,
+// keeping its session if it asked for that.
+func leave(c *Client) {
+	clients.RemoveClient(c)
+	if c.CleanSession() {
+		c.Free()
+		// The session may have been stored while the client was connected.
+		sessions.Remove(c.ClientId)
+		return
+	}
+	sessions.Save(c)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSessionCheckpoint(t *testing.T) {
+	a := dialSN(t)
+	a.connect("ckpt", false)
+	a.subscribe("/ckpt/#", 1)
+	testStorage.waitSession(t, "ckpt", func(s *StoredSession) bool {
+		return s != nil && s.Subscriptions["/ckpt/#"] == 1
+	})
+
+	a.send(NewMessage(DISCONNECT))
+	a.recv()
+	c := dialSN(t)
+	c.connect("ckpt-pub", true)
+	c.publish(c.register("/ckpt/x"), 1, "queued")
+	testStorage.waitSession(t, "ckpt", func(s *StoredSession) bool {
+		return s != nil && len(s.Queue) == 1 && string(s.Queue[0].Data) == "queued"
+	})
+
+	// The message goes in flight and is acknowledged.
+	a.connect("ckpt", false)
+	p := a.receivePublish()
+	testStorage.waitSession(t, "ckpt", func(s *StoredSession) bool {
+		return s != nil && len(s.Queue) == 0 && len(s.Inflight) == 1
+	})
+	ack := NewMessage(PUBACK).(*PubackMessage)
+	ack.TopicId = p.TopicId
+	ack.MessageId = p.MessageId
+	ack.ReturnCode = ACCEPTED
+	a.send(ack)
+	testStorage.waitSession(t, "ckpt", func(s *StoredSession) bool {
+		return s != nil && len(s.Inflight) == 0
+	})
+
+	// A clean session removes the stored one, even though the client is
+	// connected.
+	a.connect("ckpt", true)
+	testStorage.waitSession(t, "ckpt", func(s *StoredSession) bool {
+		return s == nil
+	})
+}
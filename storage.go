@@ -0,0 +1,148 @@
+package main
+
+import (
+	"time"
+)
+
+// Storage keeps the state of the broker across restarts: the topic
+// registry, retained messages and persistent sessions with their messages in
+// flight.
+type Storage interface {
+	PutTopic(id uint16, topic string) error
+	DeleteTopic(id uint16) error
+	PutRetained(topic string, msg *PublishMessage) error
+	DeleteRetained(topic string) error
+	PutSession(session *StoredSession) error
+	DeleteSession(clientId string) error
+	// Load returns everything kept by the storage.
+	Load() (*StoredState, error)
+	Close() error
+}
+
+// StoredMessage is a message as kept by a Storage.
+type StoredMessage struct {
+	Topic     string `json:",omitempty"`
+	TopicId   uint16 `json:",omitempty"`
+	IdType    byte   `json:",omitempty"`
+	MessageId uint16 `json:",omitempty"`
+	Qos       byte   `json:",omitempty"`
+	Released  bool   `json:",omitempty"`
+	Data      []byte
+}
+
+// StoredSession is the state of a persistent session as kept by a Storage.
+type StoredSession struct {
+	ClientId      string
+	Subscriptions map[string]byte
+	Topics        map[uint16]string
+	Inflight      []StoredMessage
+	Received      []uint16
+	Queue         []StoredMessage
+	NextMessageId uint16
+	// seconds the session outlives its client, zero if it never expires
+	SessionExpiry uint32 `json:",omitempty"`
+	// the client id was taken from a client certificate
+	Certified bool `json:",omitempty"`
+}
+
+// StoredState is everything kept by a Storage.
+type StoredState struct {
+	Topics   map[uint16]string
+	Retained map[string]StoredMessage
+	Sessions map[string]*StoredSession
+}
+
+// nopStorage keeps nothing. It is used when no storage is configured.
+type nopStorage struct{}
+
+func (nopStorage) PutTopic(uint16, string) error             { return nil }
+func (nopStorage) DeleteTopic(uint16) error                  { return nil }
+func (nopStorage) PutRetained(string, *PublishMessage) error { return nil }
+func (nopStorage) DeleteRetained(string) error               { return nil }
+func (nopStorage) PutSession(*StoredSession) error           { return nil }
+func (nopStorage) DeleteSession(string) error                { return nil }
+func (nopStorage) Close() error                              { return nil }
+func (nopStorage) Load() (*StoredState, error)               { return &StoredState{}, nil }
+
+// OpenStorage opens the storage configured in the [Storage] section of the
+// config.
+func OpenStorage() (Storage, error) {
+	if serv.Config.Storage.Path == "" {
+		return nopStorage{}, nil
+	}
+	return OpenFileStorage(serv.Config.Storage.Path)
+}
+
+// Snapshot returns the state of the client's session as kept by a Storage
+// and marks the session as stored.
+func (c *Client) Snapshot() *StoredSession {
+	defer c.Unlock()
+	c.Lock()
+	c.dirty = false
+	s := &StoredSession{
+		ClientId:      c.ClientId,
+		Subscriptions: make(map[string]byte, len(c.subscriptions)),
+		Topics:        make(map[uint16]string, len(c.registeredTopics)),
+		NextMessageId: c.nextMessageId,
+		SessionExpiry: uint32(c.sessionExpiry / time.Second),
+		Certified:     c.certified,
+	}
+	for filter, qos := range c.subscriptions {
+		s.Subscriptions[filter] = qos
+	}
+	for id, topic := range c.registeredTopics {
+		s.Topics[id] = topic
+	}
+	for id, m := range c.inflight {
+		s.Inflight = append(s.Inflight, StoredMessage{
+			Topic:     m.topic,
+			TopicId:   m.msg.TopicId,
+			IdType:    m.msg.TopicIdType,
+			MessageId: id,
+			Qos:       m.msg.Qos,
+			Released:  m.released,
+			Data:      m.msg.Data,
+		})
+	}
+	for id := range c.received {
+		s.Received = append(s.Received, id)
+	}
+	for _, q := range c.queue.messages {
+		s.Queue = append(s.Queue, StoredMessage{Topic: q.topic, Qos: q.msg.Qos, Data: q.msg.Data})
+	}
+	return s
+}
+
+// restoreClient returns a disconnected client with a persistent session as
+// kept by a Storage.
+func restoreClient(s *StoredSession) *Client {
+	c := NewClient(s.ClientId, nil, nil)
+	c.state = stateDisconnected
+	c.cleanSession = false
+	c.nextMessageId = s.NextMessageId
+	c.sessionExpiry = time.Duration(s.SessionExpiry) * time.Second
+	c.certified = s.Certified
+	for filter, qos := range s.Subscriptions {
+		c.Subscribe(filter, qos)
+	}
+	for id, topic := range s.Topics {
+		c.Register(id, topic)
+	}
+	now := time.Now()
+	for _, m := range s.Inflight {
+		c.inflight[m.MessageId] = &inflightMessage{
+			topic:    m.Topic,
+			msg:      NewPublishMessage(m.TopicId, m.IdType, m.Data, m.Qos, m.MessageId, false, false),
+			sent:     now,
+			released: m.Released,
+		}
+	}
+	for _, id := range s.Received {
+		c.received[id] = true
+	}
+	for _, m := range s.Queue {
+		c.queue.push(m.Topic, NewPublishMessage(0, 0x00, m.Data, m.Qos, 0, false, false))
+	}
+	c.dirty = false
+	return c
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Subscription options. The lowest bits are the QoS level, the rest are
+// only requested by MQTT 5.0 clients.
+const (
+	subQosBits           = 0x03
+	subNoLocal           = 0x04
+	subRetainAsPublished = 0x08
+	subRetainHandling    = 0x30
+)
+
+// sharedPrefix starts the filter of a shared subscription:
+// $share/{group}/{filter}.
+const sharedPrefix = "$share/"
+
+// sharedFilter splits a shared subscription into its group and the topic
+// filter. It returns false if the filter is not a shared subscription.
+func sharedFilter(filter string) (string, string, bool) {
+	if !strings.HasPrefix(filter, sharedPrefix) {
+		return "", filter, false
+	}
+	rest := filter[len(sharedPrefix):]
+	i := strings.IndexByte(rest, '/')
+	if i < 0 {
+		return rest, "", true
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+// subscriptionTree indexes subscriptions of all clients, including saved
+// sessions, by the levels of their topic filters, so that publishing a
+// message only visits the filters that can match its topic.
+type subscriptionTree struct {
+	sync.RWMutex
+	root *subscriptionNode
+}
+
+type subscriptionNode struct {
+	children map[string]*subscriptionNode
+	// subscribers whose filter ends at this node, with their subscription
+	// options
+	subscribers map[*Client]byte
+	// shared subscriptions whose filter ends at this node, by group
+	shared map[string]*sharedGroup
+}
+
+// sharedGroup is a shared subscription. Every message goes to one of its
+// members in turn.
+type sharedGroup struct {
+	members map[*Client]byte
+	order   []*Client
+	next    uint32
+}
+
+func newSubscriptionNode() *subscriptionNode {
+	return &subscriptionNode{
+		children:    make(map[string]*subscriptionNode),
+		subscribers: make(map[*Client]byte),
+		shared:      make(map[string]*sharedGroup),
+	}
+}
+
+func newSubscriptionTree() *subscriptionTree {
+	return &subscriptionTree{root: newSubscriptionNode()}
+}
+
+// subscribe adds or replaces the subscription of a client to a filter.
+func (t *subscriptionTree) subscribe(filter string, c *Client, options byte) {
+	defer t.Unlock()
+	t.Lock()
+	group, filter, shared := sharedFilter(filter)
+	node := t.root
+	for _, level := range strings.Split(filter, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			child = newSubscriptionNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	if !shared {
+		node.subscribers[c] = options
+		return
+	}
+	g, ok := node.shared[group]
+	if !ok {
+		g = &sharedGroup{members: make(map[*Client]byte)}
+		node.shared[group] = g
+	}
+	if _, ok := g.members[c]; !ok {
+		g.order = append(g.order, c)
+	}
+	g.members[c] = options
+}
+
+// unsubscribe removes the subscription of a client to a filter, pruning
+// nodes that are no longer used.
+func (t *subscriptionTree) unsubscribe(filter string, c *Client) {
+	defer t.Unlock()
+	t.Lock()
+	group, filter, shared := sharedFilter(filter)
+	levels := strings.Split(filter, "/")
+	path := make([]*subscriptionNode, 0, len(levels)+1)
+	node := t.root
+	path = append(path, node)
+	for _, level := range levels {
+		node = node.children[level]
+		if node == nil {
+			return
+		}
+		path = append(path, node)
+	}
+	if !shared {
+		delete(node.subscribers, c)
+	} else if g := node.shared[group]; g != nil {
+		delete(g.members, c)
+		for i, member := range g.order {
+			if member == c {
+				g.order = append(g.order[:i:i], g.order[i+1:]...)
+				break
+			}
+		}
+		if len(g.members) == 0 {
+			delete(node.shared, group)
+		}
+	}
+	for i := len(levels); i > 0; i-- {
+		n := path[i]
+		if len(n.subscribers) > 0 || len(n.shared) > 0 || len(n.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, levels[i-1])
+	}
+}
+
+// match returns the clients subscribed to a topic with the options of their
+// matching subscription with the highest QoS level. Shared subscriptions
+// contribute one of their members each.
+func (t *subscriptionTree) match(topic string) map[*Client]byte {
+	defer t.RUnlock()
+	t.RLock()
+	matches := make(map[*Client]byte)
+	levels := strings.Split(topic, "/")
+	// Wildcards do not match topics beginning with '$' at the first level.
+	wildcards := len(topic) == 0 || topic[0] != '$'
+	t.root.match(levels, wildcards, matches)
+	return matches
+}
+
+func (n *subscriptionNode) match(levels []string, wildcards bool, matches map[*Client]byte) {
+	if wildcards {
+		// A multi-level wildcard also matches the absence of a level.
+		if child := n.children["#"]; child != nil {
+			child.collect(matches)
+		}
+	}
+	if len(levels) == 0 {
+		n.collect(matches)
+		return
+	}
+	if child := n.children[levels[0]]; child != nil {
+		child.match(levels[1:], true, matches)
+	}
+	if wildcards {
+		if child := n.children["+"]; child != nil {
+			child.match(levels[1:], true, matches)
+		}
+	}
+}
+
+func (n *subscriptionNode) collect(matches map[*Client]byte) {
+	for c, options := range n.subscribers {
+		addMatch(matches, c, options)
+	}
+	for _, g := range n.shared {
+		c := g.order[atomic.AddUint32(&g.next, 1)%uint32(len(g.order))]
+		addMatch(matches, c, g.members[c])
+	}
+}
+
+func addMatch(matches map[*Client]byte, c *Client, options byte) {
+	if o, ok := matches[c]; !ok || options&subQosBits > o&subQosBits {
+		matches[c] = options
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestSubscriptionMatch(t *testing.T) {
+	filters := []string{"/a/b", "/a/+", "/a/#", "+/+", "#", "+/uptime", "$SYS/#", "$SYS/+"}
+	tests := []struct {
+		topic   string
+		matches []string
+	}{
+		{"/a/b", []string{"/a/b", "/a/+", "/a/#", "#"}},
+		{"/a", []string{"/a/#", "+/+", "#"}},
+		{"/a/b/c", []string{"/a/#", "#"}},
+		{"/b", []string{"+/+", "#"}},
+		{"$SYS/uptime", []string{"$SYS/#", "$SYS/+"}},
+		{"$SYS", []string{"$SYS/#"}},
+		{"SYS/uptime", []string{"+/+", "#", "+/uptime"}},
+	}
+	tree := newSubscriptionTree()
+	subscribers := make(map[*Client]string)
+	for _, filter := range filters {
+		c := NewClient(filter, nil, nil)
+		tree.subscribe(filter, c, 0)
+		subscribers[c] = filter
+	}
+	for _, test := range tests {
+		matches := tree.match(test.topic)
+		if len(matches) != len(test.matches) {
+			t.Errorf("%s matched %d filters, expected %v", test.topic, len(matches), test.matches)
+			continue
+		}
+		for _, filter := range test.matches {
+			found := false
+			for c := range matches {
+				found = found || subscribers[c] == filter
+			}
+			if !found {
+				t.Errorf("%s did not match %s", test.topic, filter)
+			}
+		}
+	}
+}
+
+func TestSubscriptionHighestQos(t *testing.T) {
+	tree := newSubscriptionTree()
+	c := NewClient("qos", nil, nil)
+	tree.subscribe("/a/+", c, 1|subNoLocal)
+	tree.subscribe("/a/b", c, 2)
+	tree.subscribe("/a/#", c, 0)
+	if options := tree.match("/a/b")[c]; options != 2 {
+		t.Fatal("expected options of the QoS 2 subscription, got", options)
+	}
+	tree.subscribe("/a/b", c, 0)
+	if options := tree.match("/a/b")[c]; options != 1|subNoLocal {
+		t.Fatal("expected options of the QoS 1 subscription, got", options)
+	}
+}
+
+func TestUnsubscribePrunes(t *testing.T) {
+	tree := newSubscriptionTree()
+	a := NewClient("a", nil, nil)
+	b := NewClient("b", nil, nil)
+	tree.subscribe("/a/b/c", a, 0)
+	tree.subscribe("/a/b", b, 0)
+	tree.subscribe("/a/b/c", b, 0)
+
+	tree.unsubscribe("/a/b/c", a)
+	if len(tree.match("/a/b/c")) != 1 {
+		t.Fatal("subscription of b lost")
+	}
+	tree.unsubscribe("/a/b/c", b)
+	b1 := tree.root.children[""].children["a"].children["b"]
+	if len(b1.children) != 0 {
+		t.Fatal("unused node not pruned")
+	}
+	// Unknown filters leave the tree alone.
+	tree.unsubscribe("/a/b/c/d", b)
+	tree.unsubscribe("/a/b", a)
+	if len(tree.match("/a/b")) != 1 {
+		t.Fatal("subscription of b lost")
+	}
+	tree.unsubscribe("/a/b", b)
+	if len(tree.root.children) != 0 {
+		t.Fatal("tree not empty after the last subscription went away")
+	}
+}
+
+func TestSharedSubscriptionLastMember(t *testing.T) {
+	tree := newSubscriptionTree()
+	a := NewClient("a", nil, nil)
+	b := NewClient("b", nil, nil)
+	tree.subscribe("$share/group/s/+", a, 0)
+	tree.subscribe("$share/group/s/+", b, 1)
+
+	got := make(map[*Client]int)
+	for i := 0; i < 4; i++ {
+		matches := tree.match("s/x")
+		if len(matches) != 1 {
+			t.Fatal("expected one member of the group, got", len(matches))
+		}
+		for c := range matches {
+			got[c]++
+		}
+	}
+	if got[a] != 2 || got[b] != 2 {
+		t.Fatal("messages not shared in turn", got[a], got[b])
+	}
+
+	tree.unsubscribe("$share/group/s/+", a)
+	for i := 0; i < 2; i++ {
+		if options, ok := tree.match("s/x")[b]; !ok || options != 1 {
+			t.Fatal("remaining member not matched")
+		}
+	}
+	tree.unsubscribe("$share/group/s/+", b)
+	if len(tree.match("s/x")) != 0 {
+		t.Fatal("group matched after its last member left")
+	}
+	if len(tree.root.children) != 0 {
+		t.Fatal("tree not empty after the group went away")
+	}
+}
+
+// BenchmarkMatchSubscriptions matches published topics against subscriptions
+// of 1000 clients to 100k topics, some of them through wildcards.
+func BenchmarkMatchSubscriptions(b *testing.B) {
+	tree := newSubscriptionTree()
+	subscribers := make([]*Client, 1000)
+	for i := range subscribers {
+		subscribers[i] = NewClient("bench"+strconv.Itoa(i), nil, nil)
+	}
+	for i := 0; i < benchTopics; i++ {
+		tree.subscribe(benchTopicName(i), subscribers[i%len(subscribers)], 1)
+	}
+	for i := 0; i < 100; i++ {
+		tree.subscribe("/sensors/"+strconv.Itoa(i)+"/+", subscribers[i], 0)
+	}
+	tree.subscribe("/sensors/#", subscribers[0], 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(tree.match(benchTopicName(i%benchTopics))) == 0 {
+			b.Fatal("no subscribers matched")
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// keepAliveTolerance is the factor applied to the keep-alive duration
+// negotiated on CONNECT before a silent client is considered lost.
+const keepAliveTolerance = 1.5
+
+// Supervise checks every `d` for clients that stopped talking to the broker
+// and expires their sessions.
+func Supervise(d time.Duration) {
+	for {
+		time.Sleep(d)
+		now := time.Now()
+		for _, client := range clients.List() {
+			if expired(client, now) {
+				log.Println("Session of", client, "from", client.AddrString(), "expired")
+				expireClient(client)
+			}
+		}
+		for _, session := range sessions.List() {
+			if sessionExpired(session, now) {
+				log.Println("Saved session of", session, "expired")
+				sessions.Remove(session.ClientId)
+				wills.End(session.ClientId)
+			}
+		}
+	}
+}
+
+// expired reports whether the client was silent for longer than allowed at
+// the given time. Clients that negotiated a keep-alive or went asleep get
+// that period multiplied by keepAliveTolerance plus the configured grace
+// period. Other MQTT-SN clients are limited by the idle timeout, if there is
+// any, while MQTT clients without keep-alive are not supervised: the loss of
+// their connection is noticed anyway.
+func expired(c *Client, now time.Time) bool {
+	lastSeen, period := c.Activity()
+	var limit time.Duration
+	if state := c.State(); period != 0 && (state == stateActive || state == stateAsleep) {
+		limit = time.Duration(float64(period)*keepAliveTolerance) +
+			time.Duration(serv.Config.Session.GracePeriod)*time.Second
+	} else if c.Stream() != nil {
+		return false
+	} else {
+		limit = time.Duration(serv.Config.Session.IdleTimeout) * time.Second
+	}
+	if limit == 0 {
+		return false
+	}
+	return now.Sub(lastSeen) > limit
+}
+
+// sessionExpired reports whether a saved session outlived the session expiry
+// interval requested by its MQTT 5.0 client.
+func sessionExpired(c *Client, now time.Time) bool {
+	expiry := c.SessionExpiry()
+	if expiry == 0 {
+		return false
+	}
+	lastSeen, _ := c.Activity()
+	return now.Sub(lastSeen) > expiry
+}
+
+// expireClient forgets a client that stopped talking to the broker without
+// disconnecting, closing its MQTT connection if there is one, and publishes
+// its will. Everything kept for the client is freed unless it asked for a
+// persistent session.
+func expireClient(c *Client) {
+	c.SetState(stateLost)
+	leave(c)
+	c.Disconnect(MQTT_KEEP_ALIVE_TIMEOUT)
+	publishWill(c)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpired(t *testing.T) {
+	// IdleTimeout is an hour in tests.
+	later := time.Now().Add(2 * time.Hour)
+
+	sn := NewClient("idle-sn", nil, nil)
+	if !expired(sn, later) {
+		t.Error("idle MQTT-SN client not expired")
+	}
+	sn.SetKeepAlive(60)
+	if !expired(sn, time.Now().Add(100*time.Second)) {
+		t.Error("MQTT-SN client not expired after its keep-alive")
+	}
+
+	mqtt := NewClient("idle-mqtt", nil, nil)
+	mqtt.Attach(&mqttConn{})
+	if expired(mqtt, later) {
+		t.Error("MQTT client without keep-alive expired")
+	}
+	mqtt.SetKeepAlive(60)
+	if !expired(mqtt, time.Now().Add(100*time.Second)) {
+		t.Error("MQTT client not expired after its keep-alive")
+	}
+}
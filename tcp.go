@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// mqttConnectTimeout is how long a new connection may take to send CONNECT.
+const mqttConnectTimeout = 10 * time.Second
+
+// mqttWriteTimeout is how long a client may keep the broker waiting while it
+// is sent a packet. Slower clients are disconnected, so that they do not hold
+// up publishers.
+const mqttWriteTimeout = 5 * time.Second
+
+// mqttTopicAliasMaximum is the number of topic aliases an MQTT 5.0 client
+// may use when publishing.
+const mqttTopicAliasMaximum = 1024
+
+// maxInboundPacketSize returns the largest packet, including the fixed
+// header, accepted from MQTT clients.
+func maxInboundPacketSize() int {
+	if max := serv.Config.MaxPacketSize; max > 0 && max < mqttMaxLength+5 {
+		return max
+	}
+	return mqttMaxLength + 5
+}
+
+// mqttConn is the connection of a client using MQTT, with the protocol level
+// and the limits negotiated on CONNECT.
+type mqttConn struct {
+	net.Conn
+	version byte
+	// messages with QoS > 0 the client accepts in flight
+	receiveMaximum int
+	// largest packet the client accepts, including the fixed header
+	maxPacketSize int
+	// topic aliases set by the client, only used by the reading goroutine
+	aliases map[uint16]string
+	// user name given on CONNECT or taken from the client certificate
+	username string
+}
+
+// disconnect closes the connection, sending DISCONNECT with the reason code
+// to MQTT 5.0 clients first.
+func (mc *mqttConn) disconnect(reason byte) {
+	if mc.version == 5 {
+		mc.SetWriteDeadline(time.Now().Add(time.Second))
+		newMQTTDisconnect(reason).Write(mc)
+	}
+	mc.Close()
+}
+
+func ListenTCP(addr string) {
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("Socket error:", err)
+			time.Sleep(3 * time.Second)
+			continue
+		}
+		go ServeMQTT(conn)
+	}
+}
+
+// ServeMQTT runs an MQTT session over the connection until either side
+// closes it.
+func ServeMQTT(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	max := maxInboundPacketSize()
+	conn.SetDeadline(time.Now().Add(mqttConnectTimeout))
+	p, err := readMQTTPacket(r, max)
+	if err != nil {
+		log.Println("Unable to read CONNECT from", conn.RemoteAddr(), ":", err)
+		return
+	}
+	if p.Type != MQTT_CONNECT {
+		log.Println("Expected CONNECT from", conn.RemoteAddr())
+		return
+	}
+	mc := &mqttConn{
+		Conn:           conn,
+		receiveMaximum: 65535,
+		maxPacketSize:  mqttMaxLength + 5,
+		aliases:        make(map[uint16]string),
+	}
+	c := connectMQTT(mc, p)
+	if c == nil {
+		return
+	}
+	// Keep-alive is watched by the supervisor.
+	conn.SetReadDeadline(time.Time{})
+
+	for {
+		p, err = readMQTTPacket(r, max)
+		if err == errTooLarge {
+			log.Println("Closing connection of", c, ":", err)
+			if c.Stream() == mc {
+				mc.disconnect(MQTT_PACKET_TOO_LARGE)
+			}
+			break
+		}
+		if err != nil {
+			break
+		}
+		c.Touch()
+		if p.Type == MQTT_DISCONNECT {
+			if err = disconnectMQTT(c, mc, p); err == nil {
+				return
+			}
+		} else {
+			err = processMQTTPacket(c, mc, p)
+		}
+		if err != nil {
+			log.Println("Closing connection of", c, ":", err)
+			if c.Stream() == mc {
+				mc.disconnect(reasonCode(err))
+			}
+			break
+		}
+	}
+	// The connection broke, unless the client was taken over or expired.
+	if c.Stream() == mc && clients.GetClientById(c.ClientId) == c {
+		log.Println("Connection of", c, "from", conn.RemoteAddr(), "lost")
+		expireClient(c)
+	}
+}
+
+// connectMQTT handles CONNECT and returns the connected client, or nil if the
+// connection is refused.
+func connectMQTT(mc *mqttConn, p *mqttPacket) *Client {
+	msg, err := parseMQTTConnect(p)
+	if err != nil {
+		log.Println("Bad CONNECT from", mc.RemoteAddr(), ":", err)
+		return nil
+	}
+	if msg.ProtocolLevel != 4 && msg.ProtocolLevel != 5 {
+		log.Println("Unsupported MQTT protocol level", msg.ProtocolLevel, "from", mc.RemoteAddr())
+		newMQTTConnack(false, MQTT_REJ_PROTOCOL, nil).Write(mc)
+		return nil
+	}
+	mc.version = msg.ProtocolLevel
+	// refuse sends CONNACK with the return code of the client's protocol
+	// level.
+	refuse := func(code, reason byte) {
+		if mc.version == 5 {
+			newMQTTConnack(false, reason, &mqttPropertyWriter{}).Write(mc)
+		} else {
+			newMQTTConnack(false, code, nil).Write(mc)
+		}
+	}
+	props := msg.Properties
+	if mc.version == 5 {
+		if props.present(propAuthMethod) {
+			log.Println("Unsupported authentication method", props.AuthMethod, "from", mc.RemoteAddr())
+			refuse(MQTT_REJ_NOT_AUTHORIZED, MQTT_BAD_AUTHENTICATION_METHOD)
+			return nil
+		}
+		if props.present(propReceiveMaximum) {
+			if props.ReceiveMaximum == 0 {
+				refuse(MQTT_REJ_PROTOCOL, MQTT_PROTOCOL_ERROR)
+				return nil
+			}
+			mc.receiveMaximum = int(props.ReceiveMaximum)
+		}
+		if props.present(propMaximumPacketSize) {
+			if props.MaximumPacketSize == 0 {
+				refuse(MQTT_REJ_PROTOCOL, MQTT_PROTOCOL_ERROR)
+				return nil
+			}
+			if props.MaximumPacketSize < uint32(mc.maxPacketSize) {
+				mc.maxPacketSize = int(props.MaximumPacketSize)
+			}
+		}
+	}
+	clientid := msg.ClientId
+	assigned := false
+	certified := false
+	if msg.Username != nil {
+		mc.username = *msg.Username
+	}
+	if identity := certificateIdentity(mc.Conn); identity != "" {
+		if strings.EqualFold(serv.Config.TLS.IdentityAs, "username") {
+			log.Println("Connection from", mc.RemoteAddr(), "authenticated as user", identity)
+			mc.username = identity
+		} else {
+			// The certificate decides the client id.
+			if clientid != "" && clientid != identity {
+				log.Println("Client id", clientid, "does not match certificate of", identity)
+				refuse(MQTT_REJ_IDENTIFIER, MQTT_CLIENT_ID_NOT_VALID)
+				return nil
+			}
+			assigned = clientid == ""
+			clientid = identity
+			certified = true
+		}
+	}
+	if !certified && certifiedClientId(clientid) {
+		log.Println("Client id", clientid, "belongs to a certificate, refusing", mc.RemoteAddr())
+		refuse(MQTT_REJ_NOT_AUTHORIZED, MQTT_NOT_AUTHORIZED)
+		return nil
+	}
+	if clientid == "" {
+		// MQTT 3.1.1 only allows a generated client id for clean sessions.
+		if mc.version != 5 && !msg.CleanSession {
+			refuse(MQTT_REJ_IDENTIFIER, MQTT_CLIENT_ID_NOT_VALID)
+			return nil
+		}
+		clientid = generateClientId()
+		assigned = true
+	}
+	if msg.Will != nil {
+		if err = validateMQTTTopicName(msg.Will.Topic); err != nil {
+			log.Println("Bad will topic from", mc.RemoteAddr(), ":", err)
+			refuse(MQTT_REJ_NOT_AUTHORIZED, MQTT_TOPIC_NAME_INVALID)
+			return nil
+		}
+		if err = validateMessageProperties(msg.Will.Properties); err != nil {
+			log.Println("Bad will properties from", mc.RemoteAddr(), ":", err)
+			refuse(MQTT_REJ_NOT_AUTHORIZED, reasonCode(err))
+			return nil
+		}
+	}
+
+	if old := clients.GetClientById(clientid); old != nil {
+		// The new connection takes over the session.
+		log.Println("Client", clientid, "reconnected from", mc.RemoteAddr())
+		old.SetWillTopic("", 0, false)
+		old.SetState(stateDisconnected)
+		leave(old)
+		if old.Stream() == nil {
+			if err := old.Write(NewMessage(DISCONNECT)); err != nil {
+				log.Println(err)
+			}
+		}
+		old.Disconnect(MQTT_SESSION_TAKEN_OVER)
+	}
+	var c *Client
+	sessionPresent := false
+	if !msg.CleanSession {
+		c = sessions.Take(clientid)
+		if c != nil && c.Certified() != certified {
+			// A session left by a client without the certificate is not
+			// handed to the owner of the certificate.
+			c = nil
+		}
+		sessionPresent = c != nil
+	}
+	if c == nil {
+		sessions.Remove(clientid)
+		c = NewClient(clientid, nil, nil)
+	}
+	wills.Resume(clientid, sessionPresent)
+	c.Attach(mc)
+	c.SetCertified(certified)
+	c.SetWill(msg.Will)
+	if mc.version == 5 {
+		// MQTT 5.0 keeps the session for the requested interval instead.
+		c.SetCleanSession(props.SessionExpiry == 0)
+		c.SetSessionExpiry(sessionExpiry(props.SessionExpiry))
+	} else {
+		c.SetCleanSession(msg.CleanSession)
+	}
+	c.SetKeepAlive(msg.KeepAlive)
+	c.Touch()
+	c.SetState(stateActive)
+	clients.AddClient(c)
+
+	var ackProps *mqttPropertyWriter
+	if mc.version == 5 {
+		ackProps = &mqttPropertyWriter{}
+		ackProps.uint16(propTopicAliasMaximum, mqttTopicAliasMaximum)
+		ackProps.uint32(propMaximumPacketSize, uint32(maxInboundPacketSize()))
+		ackProps.byte(propSubscriptionIdsAvail, 0)
+		if assigned {
+			ackProps.bytes(propAssignedClientId, []byte(clientid))
+		}
+	}
+	if err = c.WritePacket(newMQTTConnack(sessionPresent, MQTT_ACCEPTED, ackProps)); err != nil {
+		log.Println(err)
+	}
+	resendMQTT(c)
+	deliverQueued(c)
+	return c
+}
+
+// sessionExpiry converts the session expiry interval of MQTT 5.0 to how long
+// the session is kept, zero meaning forever.
+func sessionExpiry(interval uint32) time.Duration {
+	if interval == sessionNeverExpires {
+		return 0
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// disconnectMQTT handles DISCONNECT sent by a client. Clients using MQTT 5.0
+// may update the session expiry interval, or ask for their will to be
+// published anyway.
+func disconnectMQTT(c *Client, mc *mqttConn, p *mqttPacket) error {
+	withWill := false
+	if mc.version == 5 {
+		reason, props, err := parseMQTTDisconnect(p)
+		if err != nil {
+			return err
+		}
+		if props.present(propSessionExpiry) {
+			if c.CleanSession() && props.SessionExpiry != 0 {
+				return &mqttError{MQTT_PROTOCOL_ERROR, "session expiry set on DISCONNECT"}
+			}
+			c.SetCleanSession(props.SessionExpiry == 0)
+			c.SetSessionExpiry(sessionExpiry(props.SessionExpiry))
+		}
+		withWill = reason == MQTT_DISCONNECT_WITH_WILL
+	}
+	if c.Stream() != mc {
+		return nil
+	}
+	if !withWill {
+		c.SetWillTopic("", 0, false)
+	}
+	c.SetState(stateDisconnected)
+	leave(c)
+	publishWill(c)
+	return nil
+}
+
+// processMQTTPacket handles a packet from a connected client. An error means
+// that the client violated the protocol and must be disconnected.
+func processMQTTPacket(c *Client, mc *mqttConn, p *mqttPacket) error {
+	switch p.Type {
+	case MQTT_PUBLISH:
+		msg, err := parseMQTTPublish(p, mc.version)
+		if err != nil {
+			return err
+		}
+		topic, err := publishedMQTTTopic(mc, msg)
+		if err != nil {
+			return err
+		}
+		pub := NewPublishMessage(0, 0x00, msg.Payload, msg.Qos, 0, msg.Retain, false)
+		if mc.version == 5 {
+			pub.Properties = newMessageProperties(msg.Properties, c.ClientId)
+		}
+		switch msg.Qos {
+		case 0:
+			publish(topic, pub)
+		case 1:
+			reason := byte(MQTT_SUCCESS)
+			if publish(topic, pub) == 0 {
+				reason = MQTT_NO_MATCHING_SUBSCRIBERS
+			}
+			return c.WritePacket(newMQTTAck(MQTT_PUBACK, msg.PacketId, mc.reason(reason)))
+		case 2:
+			reason := byte(MQTT_SUCCESS)
+			if c.Receive(msg.PacketId) && publish(topic, pub) == 0 {
+				reason = MQTT_NO_MATCHING_SUBSCRIBERS
+			}
+			return c.WritePacket(newMQTTAck(MQTT_PUBREC, msg.PacketId, mc.reason(reason)))
+		}
+	case MQTT_PUBACK, MQTT_PUBCOMP:
+		id, _, err := parseMQTTAck(p, mc.version)
+		if err != nil {
+			return err
+		}
+		if !c.Acknowledge(id) {
+			log.Println("Acknowledgement for unknown message", id, "from", c)
+		}
+		// Messages may be waiting for room within the receive maximum.
+		deliverQueued(c)
+	case MQTT_PUBREC:
+		id, reason, err := parseMQTTAck(p, mc.version)
+		if err != nil {
+			return err
+		}
+		if reason >= 0x80 {
+			// The client refused the message, which ends the exchange.
+			c.Acknowledge(id)
+			deliverQueued(c)
+			return nil
+		}
+		reason = MQTT_SUCCESS
+		if !c.Confirm(id) {
+			log.Println("PUBREC for unknown message", id, "from", c)
+			reason = MQTT_PACKET_ID_NOT_FOUND
+		}
+		return c.WritePacket(newMQTTAck(MQTT_PUBREL, id, mc.reason(reason)))
+	case MQTT_PUBREL:
+		if p.Flags != 0x02 {
+			return errors.New("bad PUBREL flags")
+		}
+		id, _, err := parseMQTTAck(p, mc.version)
+		if err != nil {
+			return err
+		}
+		c.Release(id)
+		return c.WritePacket(newMQTTAck(MQTT_PUBCOMP, id, MQTT_SUCCESS))
+	case MQTT_SUBSCRIBE:
+		msg, err := parseMQTTSubscribe(p, mc.version)
+		if err != nil {
+			return err
+		}
+		if msg.Properties.present(propSubscriptionId) {
+			return &mqttError{MQTT_PROTOCOL_ERROR, "subscription identifiers are not supported"}
+		}
+		codes := make([]byte, len(msg.Filters))
+		existed := make([]bool, len(msg.Filters))
+		for i, f := range msg.Filters {
+			if _, err := ValidateTopicFilter(f.Topic); err != nil {
+				log.Println(err)
+				codes[i] = MQTT_SUBSCRIBE_FAILURE
+				if mc.version == 5 {
+					codes[i] = MQTT_TOPIC_FILTER_INVALID
+				}
+				continue
+			}
+			if _, _, shared := sharedFilter(f.Topic); shared && f.Options&subNoLocal != 0 {
+				return &mqttError{MQTT_PROTOCOL_ERROR, "No Local on a shared subscription"}
+			}
+			existed[i] = c.Subscribe(f.Topic, f.Options)
+			codes[i] = f.Options & subQosBits
+		}
+		if err = c.WritePacket(newMQTTSuback(MQTT_SUBACK, msg.PacketId, codes, mc.version)); err != nil {
+			return err
+		}
+		for i, f := range msg.Filters {
+			if codes[i] >= 0x80 {
+				continue
+			}
+			// Retain handling: 0 sends retained messages on every
+			// subscription, 1 only on new ones, 2 never.
+			switch f.Options & subRetainHandling >> 4 {
+			case 0:
+			case 1:
+				if existed[i] {
+					continue
+				}
+			default:
+				continue
+			}
+			deliverRetained(c, f.Topic, f.Options&subQosBits)
+		}
+	case MQTT_UNSUBSCRIBE:
+		msg, err := parseMQTTUnsubscribe(p, mc.version)
+		if err != nil {
+			return err
+		}
+		codes := make([]byte, len(msg.Filters))
+		for i, filter := range msg.Filters {
+			if !c.Unsubscribe(filter) {
+				codes[i] = MQTT_NO_SUBSCRIPTION_EXISTED
+			}
+		}
+		return c.WritePacket(newMQTTSuback(MQTT_UNSUBACK, msg.PacketId, codes, mc.version))
+	case MQTT_PINGREQ:
+		return c.WritePacket(&mqttPacket{Type: MQTT_PINGRESP})
+	default:
+		return &mqttError{MQTT_PROTOCOL_ERROR, "unexpected " + mqttPacketName(p.Type)}
+	}
+	return nil
+}
+
+// reason returns the reason code to acknowledge a packet with, which is
+// always success before MQTT 5.0.
+func (mc *mqttConn) reason(code byte) byte {
+	if mc.version != 5 {
+		return MQTT_SUCCESS
+	}
+	return code
+}
+
+// publishedMQTTTopic resolves the topic of PUBLISH received from a client,
+// which MQTT 5.0 clients may replace with a topic alias, and checks the
+// properties that go along with the message.
+func publishedMQTTTopic(mc *mqttConn, msg *mqttPublish) (string, error) {
+	topic := msg.Topic
+	if mc.version == 5 {
+		if err := validateMessageProperties(msg.Properties); err != nil {
+			return "", err
+		}
+		if msg.Properties.present(propSubscriptionId) {
+			return "", &mqttError{MQTT_PROTOCOL_ERROR, "subscription identifier on PUBLISH"}
+		}
+		if msg.Properties.present(propTopicAlias) {
+			alias := msg.Properties.TopicAlias
+			if alias == 0 || alias > mqttTopicAliasMaximum {
+				return "", &mqttError{MQTT_TOPIC_ALIAS_INVALID, "invalid topic alias"}
+			}
+			if topic == "" {
+				var ok bool
+				if topic, ok = mc.aliases[alias]; !ok {
+					return "", &mqttError{MQTT_PROTOCOL_ERROR, "unknown topic alias"}
+				}
+			} else {
+				mc.aliases[alias] = topic
+			}
+		}
+	}
+	if err := validateMQTTTopicName(topic); err != nil {
+		return "", &mqttError{MQTT_TOPIC_NAME_INVALID, err.Error()}
+	}
+	return topic, nil
+}
+
+// sendMQTT writes a message on the topic to a client connected over MQTT,
+// tracking it if its QoS requires an acknowledgement. Messages beyond the
+// receive maximum of the client are queued, and messages larger than the
+// client accepts are dropped.
+func sendMQTT(c *Client, topic string, p *PublishMessage) {
+	stream := c.Stream()
+	if stream == nil {
+		return
+	}
+	if p.Qos > 0 && !c.TrackWithin(topic, p, stream.receiveMaximum) {
+		return
+	}
+	packet := newMQTTPublish(topic, p, stream.version)
+	if len(packet.Body)+5 > stream.maxPacketSize {
+		log.Println("Message on", topic, "is too large for", c, ", dropping it")
+		if p.Qos > 0 {
+			c.Acknowledge(p.MessageId)
+		}
+		return
+	}
+	if err := c.WritePacket(packet); err != nil {
+		log.Println(err)
+	}
+}
+
+// resendMQTT sends everything in flight to a client that resumed its session
+// over MQTT again.
+func resendMQTT(c *Client) {
+	stream := c.Stream()
+	if stream == nil {
+		return
+	}
+	for _, m := range c.Inflight() {
+		var err error
+		if m.released {
+			err = c.WritePacket(newMQTTAck(MQTT_PUBREL, m.msg.MessageId, MQTT_SUCCESS))
+		} else {
+			err = c.WritePacket(newMQTTPublish(m.topic, m.msg, stream.version))
+		}
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+// WritePacket sends an MQTT packet to a client connected over MQTT.
+func (c *Client) WritePacket(p *mqttPacket) error {
+	stream := c.Stream()
+	if stream == nil {
+		return errors.New("client " + c.ClientId + " is not connected over MQTT")
+	}
+	stream.SetWriteDeadline(time.Now().Add(mqttWriteTimeout))
+	if err := p.Write(stream); err != nil {
+		// The reading goroutine notices and expires the client.
+		stream.Close()
+		return err
+	}
+	return nil
+}
+
+func validateMQTTTopicName(topic string) error {
+	if len(topic) == 0 {
+		return errors.New("TopicName cannot be empty string")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return errors.New("TopicName cannot contain wildcard")
+	}
+	return nil
+}
+
+// generateClientId returns a random client id for clients that connect
+// without one.
+func generateClientId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "auto-" + hex.EncodeToString(b)
+}
+
+func mqttPacketName(packetType byte) string {
+	names := [...]string{"reserved packet", "CONNECT", "CONNACK", "PUBLISH",
+		"PUBACK", "PUBREC", "PUBREL", "PUBCOMP", "SUBSCRIBE", "SUBACK",
+		"UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT",
+		"AUTH"}
+	return names[packetType&0x0F]
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// mqttClient is an MQTT client talking to the test broker over a pipe.
+// Packets are read as they come, so that the broker is never kept waiting.
+type mqttClient struct {
+	t       testing.TB
+	conn    net.Conn
+	packets chan *mqttPacket
+	version byte
+}
+
+func dialMQTT(t testing.TB, version byte) *mqttClient {
+	client, server := net.Pipe()
+	go ServeMQTT(server)
+	return newMQTTClient(t, client, version)
+}
+
+// newMQTTClient starts reading packets from a connection to the broker.
+func newMQTTClient(t testing.TB, client net.Conn, version byte) *mqttClient {
+	c := &mqttClient{t, client, make(chan *mqttPacket, 100), version}
+	go func() {
+		r := bufio.NewReader(client)
+		for {
+			p, err := readMQTTPacket(r, mqttMaxLength+5)
+			if err != nil {
+				close(c.packets)
+				return
+			}
+			c.packets <- p
+		}
+	}()
+	return c
+}
+
+func (c *mqttClient) send(p *mqttPacket) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if err := p.Write(c.conn); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read returns the next packet, or nil if there is none after d or the
+// connection is closed.
+func (c *mqttClient) read(d time.Duration) *mqttPacket {
+	select {
+	case p := <-c.packets:
+		return p
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func (c *mqttClient) recv(packetType byte) *mqttPacket {
+	c.t.Helper()
+	p := c.read(2 * time.Second)
+	if p == nil {
+		c.t.Fatal("expected", mqttPacketName(packetType))
+	}
+	if p.Type != packetType {
+		c.t.Fatalf("expected %s, got %s %v", mqttPacketName(packetType), mqttPacketName(p.Type), p.Body)
+	}
+	return p
+}
+
+func (c *mqttClient) expectNone() {
+	c.t.Helper()
+	if p := c.read(300 * time.Millisecond); p != nil {
+		c.t.Fatalf("unexpected %s %v", mqttPacketName(p.Type), p.Body)
+	}
+}
+
+// connect sends CONNECT and returns CONNACK. MQTT 5.0 clients send the
+// properties, if any.
+func (c *mqttClient) connect(id string, clean bool, props *mqttPropertyWriter) *mqttPacket {
+	c.t.Helper()
+	var buf bytes.Buffer
+	writeMQTTString(&buf, []byte("MQTT"))
+	buf.WriteByte(c.version)
+	if clean {
+		buf.WriteByte(0x02)
+	} else {
+		buf.WriteByte(0x00)
+	}
+	buf.Write(encodeUint16(60))
+	if c.version == 5 {
+		if props == nil {
+			props = &mqttPropertyWriter{}
+		}
+		props.writeTo(&buf)
+	}
+	writeMQTTString(&buf, []byte(id))
+	c.send(&mqttPacket{Type: MQTT_CONNECT, Body: buf.Bytes()})
+	return c.recv(MQTT_CONNACK)
+}
+
+// connectWill connects with a will and a session that expires after the
+// given interval, using MQTT 5.0.
+func (c *mqttClient) connectWill(id string, clean bool, sessionExpiry, willDelay uint32, willTopic string) {
+	c.t.Helper()
+	var buf bytes.Buffer
+	writeMQTTString(&buf, []byte("MQTT"))
+	buf.WriteByte(5)
+	flags := byte(0x04)
+	if clean {
+		flags |= 0x02
+	}
+	buf.WriteByte(flags)
+	buf.Write(encodeUint16(60))
+	props := &mqttPropertyWriter{}
+	props.uint32(propSessionExpiry, sessionExpiry)
+	props.writeTo(&buf)
+	writeMQTTString(&buf, []byte(id))
+	willProps := &mqttPropertyWriter{}
+	willProps.uint32(propWillDelay, willDelay)
+	willProps.writeTo(&buf)
+	writeMQTTString(&buf, []byte(willTopic))
+	writeMQTTString(&buf, []byte(id+" is gone"))
+	c.send(&mqttPacket{Type: MQTT_CONNECT, Body: buf.Bytes()})
+	c.recv(MQTT_CONNACK)
+}
+
+// sync returns once the broker handled everything sent before.
+func (c *mqttClient) sync() {
+	c.t.Helper()
+	c.send(&mqttPacket{Type: MQTT_PINGREQ})
+	c.recv(MQTT_PINGRESP)
+}
+
+// subscribe subscribes to a topic filter with the options and returns the
+// SUBACK return code.
+func (c *mqttClient) subscribe(filter string, options byte) byte {
+	c.t.Helper()
+	var buf bytes.Buffer
+	buf.Write(encodeUint16(1))
+	if c.version == 5 {
+		buf.WriteByte(0)
+	}
+	writeMQTTString(&buf, []byte(filter))
+	buf.WriteByte(options)
+	c.send(&mqttPacket{Type: MQTT_SUBSCRIBE, Flags: 0x02, Body: buf.Bytes()})
+	body := c.recv(MQTT_SUBACK).Body
+	return body[len(body)-1]
+}
+
+// publish sends a message with packet identifier 1 if its QoS requires one.
+// MQTT 5.0 clients send the properties, if any.
+func (c *mqttClient) publish(topic, data string, qos byte, retain bool, props *mqttPropertyWriter) {
+	c.t.Helper()
+	msg := NewPublishMessage(0, 0x00, []byte(data), qos, 1, retain, false)
+	p := newMQTTPublish(topic, msg, 4)
+	if c.version == 5 {
+		var buf bytes.Buffer
+		writeMQTTString(&buf, []byte(topic))
+		if qos > 0 {
+			buf.Write(encodeUint16(1))
+		}
+		if props == nil {
+			props = &mqttPropertyWriter{}
+		}
+		props.writeTo(&buf)
+		buf.WriteString(data)
+		p.Body = buf.Bytes()
+	}
+	c.send(p)
+}
+
+// receivePublish reads PUBLISH, acknowledging it if its QoS requires that.
+func (c *mqttClient) receivePublish() *mqttPublish {
+	c.t.Helper()
+	msg, err := parseMQTTPublish(c.recv(MQTT_PUBLISH), c.version)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	switch msg.Qos {
+	case 1:
+		c.send(newMQTTAck(MQTT_PUBACK, msg.PacketId, MQTT_SUCCESS))
+	case 2:
+		c.send(newMQTTAck(MQTT_PUBREC, msg.PacketId, MQTT_SUCCESS))
+		c.recv(MQTT_PUBREL)
+		c.send(newMQTTAck(MQTT_PUBCOMP, msg.PacketId, MQTT_SUCCESS))
+	}
+	return msg
+}
+
+func TestMQTTSNToMQTT(t *testing.T) {
+	m := dialMQTT(t, 4)
+	if ack := m.connect("e2e-mqtt", true, nil); !bytes.Equal(ack.Body, []byte{0, MQTT_ACCEPTED}) {
+		t.Fatal("bad CONNACK", ack.Body)
+	}
+	if code := m.subscribe("/e2e/+", 1); code != 1 {
+		t.Fatal("bad SUBACK return code", code)
+	}
+
+	sn := dialSN(t)
+	sn.connect("e2e-sn", true)
+	sn.subscribe("/e2e-back", 0)
+	sn.publish(sn.register("/e2e/sn"), 1, "from MQTT-SN")
+	msg := m.receivePublish()
+	if msg.Topic != "/e2e/sn" || msg.Qos != 1 || string(msg.Payload) != "from MQTT-SN" {
+		t.Fatalf("got %+v", msg)
+	}
+	if _, ok := sn.recv().(*PubackMessage); !ok {
+		t.Fatal("expected PUBACK")
+	}
+
+	m.publish("/e2e-back", "from MQTT", 0, false, nil)
+	if p := sn.receivePublish(); string(p.Data) != "from MQTT" {
+		t.Fatalf("got %q", p.Data)
+	}
+	m.expectNone()
+}
+
+func TestMQTTStalledSubscriber(t *testing.T) {
+	// The subscriber reads CONNACK and SUBACK only.
+	client, server := net.Pipe()
+	go ServeMQTT(server)
+	m := &mqttClient{t, client, make(chan *mqttPacket), 4}
+	go func() {
+		r := bufio.NewReader(client)
+		for i := 0; i < 2; i++ {
+			p, _ := readMQTTPacket(r, mqttMaxLength+5)
+			m.packets <- p
+		}
+	}()
+	m.connect("stalled", true, nil)
+	m.subscribe("/stalled", 1)
+
+	// The publisher gets PUBACK once the broker gives up on the subscriber.
+	sn := dialSN(t)
+	sn.connect("stalled-pub", true)
+	sn.publish(sn.register("/stalled"), 1, "x")
+	if _, ok := sn.read(mqttWriteTimeout + 2*time.Second).(*PubackMessage); !ok {
+		t.Fatal("expected PUBACK")
+	}
+	if clients.GetClientById("stalled") != nil {
+		t.Fatal("stalled subscriber still connected")
+	}
+}
+
+func TestMQTTTopicAlias(t *testing.T) {
+	sub := dialMQTT(t, 4)
+	sub.connect("alias-sub", true, nil)
+	sub.subscribe("/alias/#", 0)
+
+	pub := dialMQTT(t, 5)
+	pub.connect("alias-pub", true, nil)
+	alias := &mqttPropertyWriter{}
+	alias.uint16(propTopicAlias, 3)
+	pub.publish("/alias/a", "1", 0, false, alias)
+	pub.publish("", "2", 0, false, alias)
+	for _, want := range []string{"1", "2"} {
+		if msg := sub.receivePublish(); msg.Topic != "/alias/a" || string(msg.Payload) != want {
+			t.Fatalf("got %+v", msg)
+		}
+	}
+
+	unknown := &mqttPropertyWriter{}
+	unknown.uint16(propTopicAlias, 4)
+	pub.publish("", "3", 0, false, unknown)
+	if p := pub.recv(MQTT_DISCONNECT); p.Body[0] != MQTT_PROTOCOL_ERROR {
+		t.Fatal("bad reason", p.Body)
+	}
+
+	pub = dialMQTT(t, 5)
+	pub.connect("alias-pub", true, nil)
+	tooLarge := &mqttPropertyWriter{}
+	tooLarge.uint16(propTopicAlias, mqttTopicAliasMaximum+1)
+	pub.publish("/alias/a", "4", 0, false, tooLarge)
+	if p := pub.recv(MQTT_DISCONNECT); p.Body[0] != MQTT_TOPIC_ALIAS_INVALID {
+		t.Fatal("bad reason", p.Body)
+	}
+	sub.expectNone()
+}
+
+func TestMQTTNoLocal(t *testing.T) {
+	a := dialMQTT(t, 5)
+	a.connect("nolocal-a", true, nil)
+	a.subscribe("/nolocal", subNoLocal)
+	b := dialMQTT(t, 5)
+	b.connect("nolocal-b", true, nil)
+	b.subscribe("/nolocal", 0)
+
+	a.publish("/nolocal", "from a", 0, false, nil)
+	if msg := b.receivePublish(); string(msg.Payload) != "from a" {
+		t.Fatalf("got %+v", msg)
+	}
+	a.expectNone()
+	b.publish("/nolocal", "from b", 0, false, nil)
+	if msg := a.receivePublish(); string(msg.Payload) != "from b" {
+		t.Fatalf("got %+v", msg)
+	}
+	if msg := b.receivePublish(); string(msg.Payload) != "from b" {
+		t.Fatalf("got %+v", msg)
+	}
+}
+
+func TestMQTTSharedSubscription(t *testing.T) {
+	members := []*mqttClient{dialMQTT(t, 5), dialMQTT(t, 5)}
+	for i, m := range members {
+		m.connect("shared-"+string('a'+rune(i)), true, nil)
+		m.subscribe("$share/group//shared/+", 0)
+	}
+	sn := dialSN(t)
+	sn.connect("shared-pub", true)
+	id := sn.register("/shared/topic")
+	for i := 0; i < 4; i++ {
+		sn.publish(id, 0, "shared")
+	}
+	// Every message goes to one member, in turn.
+	for _, m := range members {
+		m.receivePublish()
+		m.receivePublish()
+		m.expectNone()
+	}
+}
+
+func TestMQTTRetainHandling(t *testing.T) {
+	pub := dialMQTT(t, 5)
+	pub.connect("retain-pub", true, nil)
+	pub.publish("/rh/topic", "retained", 0, true, nil)
+	pub.sync()
+
+	sub := dialMQTT(t, 5)
+	sub.connect("retain-sub", true, nil)
+	tests := []struct {
+		filter   string
+		options  byte
+		retained bool
+	}{
+		{"/rh/+", 0x00, true},
+		{"/rh/+", 0x00, true},  // again on every subscription
+		{"/rh/+", 0x10, false}, // only on new subscriptions
+		{"/rh/#", 0x10, true},
+		{"/rh/topic", 0x20, false}, // never
+	}
+	for _, test := range tests {
+		sub.subscribe(test.filter, test.options)
+		if !test.retained {
+			sub.expectNone()
+			continue
+		}
+		if msg := sub.receivePublish(); !msg.Retain || string(msg.Payload) != "retained" {
+			t.Fatalf("%s with options %#x: got %+v", test.filter, test.options, msg)
+		}
+	}
+	pub.publish("/rh/topic", "", 0, true, nil)
+	pub.sync()
+}
+
+func TestMQTTWillDelay(t *testing.T) {
+	watcher := dialMQTT(t, 4)
+	watcher.connect("delay-watcher", true, nil)
+	watcher.subscribe("/delay/will", 0)
+
+	// The will waits for the delay.
+	c := dialMQTT(t, 5)
+	c.connectWill("delay", false, 60, 1, "/delay/will")
+	c.conn.Close()
+	watcher.expectNone()
+	if msg := watcher.receivePublish(); string(msg.Payload) != "delay is gone" {
+		t.Fatalf("got %+v", msg)
+	}
+
+	// It is dropped if the client resumes its session in time.
+	c = dialMQTT(t, 5)
+	c.connectWill("delay", false, 60, 1, "/delay/will")
+	c.conn.Close()
+	c = dialMQTT(t, 5)
+	c.connect("delay", false, nil)
+	if p := watcher.read(1500 * time.Millisecond); p != nil {
+		t.Fatal("will published after the client came back")
+	}
+
+	// It is published right away if the client starts a new session.
+	c.send(newMQTTDisconnect(MQTT_SUCCESS))
+	c = dialMQTT(t, 5)
+	c.connectWill("delay", false, 60, 60, "/delay/will")
+	c.conn.Close()
+	watcher.expectNone()
+	c = dialMQTT(t, 5)
+	c.connect("delay", true, nil)
+	watcher.receivePublish()
+
+	// The session may end before the delay.
+	c.send(newMQTTDisconnect(MQTT_SUCCESS))
+	c = dialMQTT(t, 5)
+	c.connectWill("delay", false, 1, 60, "/delay/will")
+	c.conn.Close()
+	watcher.expectNone()
+	if p := watcher.read(3 * time.Second); p == nil || p.Type != MQTT_PUBLISH {
+		t.Fatal("no will after the session expired")
+	}
+}
+
+func TestMQTTRetainedDollarTopic(t *testing.T) {
+	pub := dialMQTT(t, 4)
+	pub.connect("dollar-pub", true, nil)
+	pub.publish("$SYS/test/uptime", "42", 0, true, nil)
+	pub.sync()
+
+	sub := dialMQTT(t, 4)
+	sub.connect("dollar-sub", true, nil)
+	sub.subscribe("$SYS/test/#", 0)
+	if msg := sub.receivePublish(); msg.Topic != "$SYS/test/uptime" || string(msg.Payload) != "42" {
+		t.Fatalf("got %+v", msg)
+	}
+	sub.subscribe("+/test/uptime", 0)
+	sub.expectNone()
+	pub.publish("$SYS/test/uptime", "", 0, true, nil)
+	pub.sync()
+}
+
+func TestMQTTMaxPacketSize(t *testing.T) {
+	// The declared length of CONNECT alone closes the connection.
+	c := dialMQTT(t, 4)
+	go c.conn.Write([]byte{0x10, 0xFF, 0xFF, 0xFF, 0x7F})
+	select {
+	case p, ok := <-c.packets:
+		if ok {
+			t.Fatalf("unexpected %s", mqttPacketName(p.Type))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not closed")
+	}
+
+	c = dialMQTT(t, 5)
+	limit := join([]byte{propMaximumPacketSize}, []byte{0, 0, 0x10, 0})
+	if ack := c.connect("max-packet", true, nil); !bytes.Contains(ack.Body, limit) {
+		t.Fatal("no Maximum Packet Size in CONNACK", ack.Body)
+	}
+	var buf bytes.Buffer
+	msg := NewPublishMessage(0, 0x00, bytes.Repeat([]byte{'x'}, 4096), 0, 0, false, false)
+	newMQTTPublish("/max-packet", msg, 5).Write(&buf)
+	// The broker stops reading after the fixed header.
+	go c.conn.Write(buf.Bytes())
+	if p := c.recv(MQTT_DISCONNECT); p.Body[0] != MQTT_PACKET_TOO_LARGE {
+		t.Fatal("bad reason", p.Body)
+	}
+}
+
+func TestMQTTTakeoverStalled(t *testing.T) {
+	// The MQTT 5.0 client reads CONNACK only, so DISCONNECT cannot be sent.
+	client, server := net.Pipe()
+	go ServeMQTT(server)
+	m := &mqttClient{t, client, make(chan *mqttPacket), 5}
+	go func() {
+		p, _ := readMQTTPacket(bufio.NewReader(client), mqttMaxLength+5)
+		m.packets <- p
+	}()
+	m.connect("takeover-stalled", true, nil)
+
+	sn := dialSN(t)
+	c := NewMessage(CONNECT).(*ConnectMessage)
+	c.ClientId = []byte("takeover-stalled")
+	sn.send(c)
+	time.Sleep(200 * time.Millisecond)
+	// Other clients are looked up while the old connection is closed.
+	start := time.Now()
+	clients.GetClientById("takeover-other")
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatal("client lookup stalled for", d)
+	}
+	if ack, ok := sn.recv().(*ConnackMessage); !ok || ack.ReturnCode != ACCEPTED {
+		t.Fatal("takeover refused")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// tlsConfig secures the TCP and WebSocket listeners. It is nil if no
+// certificate is configured.
+var tlsConfig *tls.Config
+
+// tlsFiles holds the certificate and client CAs currently loaded from the
+// files of the [TLS] section. New handshakes pick up whatever was loaded
+// last, so that certificates can be replaced without dropping connections.
+type tlsFiles struct {
+	sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"":         tls.NoClientCert,
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"required": tls.RequireAndVerifyClientCert,
+}
+
+// LoadTLS sets up tlsConfig from the [TLS] section of the config, if it has
+// a certificate, and reloads the files on SIGHUP.
+func LoadTLS() error {
+	conf := serv.Config.TLS
+	if conf.Cert == "" {
+		return nil
+	}
+	minVersion, ok := tlsVersions[conf.MinVersion]
+	if !ok && conf.MinVersion != "" {
+		return errors.New("unknown TLS version " + conf.MinVersion)
+	}
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	clientAuth, ok := tlsClientAuth[strings.ToLower(conf.ClientAuth)]
+	if !ok {
+		return errors.New("unknown TLS client authentication " + conf.ClientAuth)
+	}
+	if clientAuth != tls.NoClientCert && conf.CA == "" {
+		return errors.New("TLS client authentication requires a CA bundle")
+	}
+	switch strings.ToUpper(conf.Identity) {
+	case "", "CN", "SAN":
+	default:
+		return errors.New("unknown TLS identity " + conf.Identity)
+	}
+	switch strings.ToLower(conf.IdentityAs) {
+	case "", "clientid", "username":
+	default:
+		return errors.New("unknown TLS identity mapping " + conf.IdentityAs)
+	}
+
+	files := &tlsFiles{}
+	if err := files.load(); err != nil {
+		return err
+	}
+	tlsConfig = &tls.Config{
+		MinVersion: minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			files.RLock()
+			defer files.RUnlock()
+			return &tls.Config{
+				MinVersion:   minVersion,
+				Certificates: []tls.Certificate{*files.cert},
+				ClientAuth:   clientAuth,
+				ClientCAs:    files.clientCAs,
+			}, nil
+		},
+	}
+	go files.reloadOnHangup()
+	return nil
+}
+
+// load reads the certificate, its key and the client CAs.
+func (f *tlsFiles) load() error {
+	conf := serv.Config.TLS
+	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if conf.CA != "" {
+		pem, err := ioutil.ReadFile(conf.CA)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates in " + conf.CA)
+		}
+	}
+	defer f.Unlock()
+	f.Lock()
+	f.cert = &cert
+	f.clientCAs = pool
+	return nil
+}
+
+func (f *tlsFiles) reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := f.load(); err != nil {
+			log.Println("Unable to reload TLS certificates, keeping the old ones:", err)
+			continue
+		}
+		log.Println("Reloaded TLS certificates")
+	}
+}
+
+// listen opens a TCP listener, with TLS if it is configured.
+func listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil || tlsConfig == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// certifiedClientId reports whether the client id was taken from a client
+// certificate by a client that is connected or has a saved session. Clients
+// without that certificate may not use it then.
+func certifiedClientId(clientId string) bool {
+	if c := clients.GetClientById(clientId); c != nil && c.Certified() {
+		return true
+	}
+	c := sessions.Get(clientId)
+	return c != nil && c.Certified()
+}
+
+// certificateIdentity returns the identity of the client certificate on the
+// connection as selected by the Identity option of the [TLS] section, or an
+// empty string if there is none.
+func certificateIdentity(conn net.Conn) string {
+	if ws, ok := conn.(*wsConn); ok {
+		conn = ws.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	cert := certs[0]
+	switch strings.ToUpper(serv.Config.TLS.Identity) {
+	case "CN":
+		return cert.Subject.CommonName
+	case "SAN":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
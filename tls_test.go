@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{t, cert, key, pool}
+}
+
+// issue returns a certificate for the common name.
+func (ca *testCA) issue(name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// dial connects to the broker over TLS with optional client certificates,
+// presenting a certificate for the common name unless it is empty.
+func (ca *testCA) dial(name string) *mqttClient {
+	client, server := net.Pipe()
+	go ServeMQTT(tls.Server(server, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue("broker")},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.pool,
+	}))
+	config := &tls.Config{RootCAs: ca.pool, ServerName: "broker"}
+	if name != "" {
+		config.Certificates = []tls.Certificate{ca.issue(name)}
+	}
+	return newMQTTClient(ca.t, tls.Client(client, config), 4)
+}
+
+func TestCertifiedClientId(t *testing.T) {
+	ca := newTestCA(t)
+	device := ca.dial("cert-device")
+	if ack := device.connect("", false, nil); ack.Body[1] != MQTT_ACCEPTED {
+		t.Fatal("certified connection refused", ack.Body)
+	}
+	device.subscribe("/cert/commands", 1)
+
+	// Neither MQTT nor MQTT-SN clients without the certificate may take the
+	// client id over, be it connected or not.
+	for _, connected := range []bool{true, false} {
+		if !connected {
+			device.send(&mqttPacket{Type: MQTT_DISCONNECT})
+			time.Sleep(100 * time.Millisecond)
+		}
+		for _, m := range []*mqttClient{dialMQTT(t, 4), ca.dial("")} {
+			if ack := m.connect("cert-device", false, nil); ack.Body[1] != MQTT_REJ_NOT_AUTHORIZED {
+				t.Fatal("client without certificate accepted", ack.Body)
+			}
+		}
+		sn := dialSN(t)
+		m := NewMessage(CONNECT).(*ConnectMessage)
+		m.ClientId = []byte("cert-device")
+		sn.send(m)
+		if ack, ok := sn.recv().(*ConnackMessage); !ok || ack.ReturnCode != REJ_NOT_SUPORTED {
+			t.Fatal("MQTT-SN client accepted")
+		}
+	}
+
+	device = ca.dial("cert-device")
+	if ack := device.connect("", false, nil); ack.Body[0] != 1 {
+		t.Fatal("session of the certified client lost", ack.Body)
+	}
+}
+
+func TestCertifiedClientIdSquatted(t *testing.T) {
+	squatter := dialMQTT(t, 4)
+	squatter.connect("cert-squatted", false, nil)
+	squatter.subscribe("/cert/#", 1)
+	squatter.send(&mqttPacket{Type: MQTT_DISCONNECT})
+	time.Sleep(100 * time.Millisecond)
+
+	device := newTestCA(t).dial("cert-squatted")
+	if ack := device.connect("cert-squatted", false, nil); ack.Body[0] != 0 || ack.Body[1] != MQTT_ACCEPTED {
+		t.Fatal("session left without certificate resumed", ack.Body)
+	}
+	pub := dialMQTT(t, 4)
+	pub.connect("cert-squatted-pub", true, nil)
+	pub.publish("/cert/squatted", "for the squatter", 0, false, nil)
+	device.expectNone()
+}
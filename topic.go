@@ -1,20 +1,26 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
+	"log"
+	"strconv"
 	"strings"
 	"sync"
 )
 
-// This needs to be efficient, but I doubt it is.
-// Raise my salary and maybe I'll fix it.
+// topicNames maps topic IDs to topic names and back.
 type topicNames struct {
 	sync.RWMutex
-	contents map[uint16]string
-	next     uint16
+	contents   map[uint16]string
+	ids        map[string]uint16
+	predefined map[uint16]bool
+	// IDs handed out since the topics were last reclaimed
+	recent map[uint16]bool
+	next   uint16
 }
 
-// O(n)
+// O(1)
 func (repo *topicNames) containsTopic(topic string) bool {
 	return repo.getId(topic) != 0
 }
@@ -24,18 +30,11 @@ func (repo *topicNames) containsId(id uint16) bool {
 	return repo.getTopic(id) != ""
 }
 
-// O(n)
+// O(1)
 func (repo *topicNames) getId(topic string) uint16 {
 	defer repo.RUnlock()
 	repo.RLock()
-	var topicid uint16
-	for id, topicVal := range repo.contents {
-		if topicVal == topic {
-			topicid = id
-			break
-		}
-	}
-	return topicid
+	return repo.ids[topic]
 }
 
 // O(1)
@@ -46,13 +45,142 @@ func (repo *topicNames) getTopic(id uint16) string {
 	return topic
 }
 
-// O(1)
+// putTopic returns the ID of a topic, assigning a new one if the topic is not
+// known yet. It returns 0 if the topic ID space is full.
+// O(1) unless used topic IDs are in the way
 func (repo *topicNames) putTopic(topic string) uint16 {
 	defer repo.Unlock()
 	repo.Lock()
-	repo.next++
-	repo.contents[repo.next] = topic
-	return repo.next
+	if id, ok := repo.ids[topic]; ok {
+		repo.recent[id] = true
+		return id
+	}
+	id := repo.allocate()
+	if id == 0 {
+		repo.reclaim(true)
+		id = repo.allocate()
+	}
+	if id == 0 {
+		// Topics handed out lately are given up only when nothing else
+		// is left.
+		repo.reclaim(false)
+		id = repo.allocate()
+	}
+	if id == 0 {
+		log.Println("Topic ID space is full, unable to add topic", topic)
+		return 0
+	}
+	repo.contents[id] = topic
+	repo.ids[topic] = id
+	repo.recent[id] = true
+	if err := store.PutTopic(id, topic); err != nil {
+		log.Println("Unable to store topic", topic, ":", err)
+	}
+	return id
+}
+
+// allocate returns the next unused topic ID, or 0 if there is none. The IDs
+// 0x0000 and 0xFFFF are reserved. The caller must hold the lock.
+func (repo *topicNames) allocate() uint16 {
+	for i := 0; i <= 0xFFFF; i++ {
+		repo.next++
+		if repo.next == 0x0000 || repo.next == 0xFFFF {
+			continue
+		}
+		if _, ok := repo.contents[repo.next]; !ok {
+			return repo.next
+		}
+	}
+	return 0
+}
+
+// reclaim forgets topics whose IDs are not referenced by any client or saved
+// session. Predefined topics are kept, and so are topics handed out since the
+// last reclaim if keepRecent is set, because their IDs may be about to be
+// registered with a client. The caller must hold the lock.
+func (repo *topicNames) reclaim(keepRecent bool) {
+	used := make(map[uint16]bool)
+	for _, client := range append(clients.List(), sessions.List()...) {
+		for _, id := range client.TopicIds() {
+			used[id] = true
+		}
+	}
+	reclaimed := 0
+	for id, topic := range repo.contents {
+		if repo.predefined[id] || (keepRecent && repo.recent[id]) || used[id] {
+			continue
+		}
+		delete(repo.contents, id)
+		delete(repo.ids, topic)
+		if err := store.DeleteTopic(id); err != nil {
+			log.Println("Unable to remove topic", topic, ":", err)
+		}
+		reclaimed++
+	}
+	repo.recent = make(map[uint16]bool)
+	log.Println("Reclaimed", reclaimed, "topic IDs")
+}
+
+// O(1)
+func (repo *topicNames) restore(id uint16, topic string) {
+	defer repo.Unlock()
+	repo.Lock()
+	if id == 0x0000 || id == 0xFFFF || repo.predefined[id] {
+		return
+	}
+	repo.contents[id] = topic
+	if _, ok := repo.ids[topic]; !ok {
+		repo.ids[topic] = id
+	}
+	if id > repo.next {
+		repo.next = id
+	}
+}
+
+// O(1)
+func (repo *topicNames) predefine(id uint16, topic string) {
+	defer repo.Unlock()
+	repo.Lock()
+	repo.contents[id] = topic
+	repo.ids[topic] = id
+	repo.predefined[id] = true
+}
+
+// O(1)
+func (repo *topicNames) isPredefined(id uint16) bool {
+	defer repo.RUnlock()
+	repo.RLock()
+	return repo.predefined[id]
+}
+
+// loadPredefinedTopics puts topics from the [PredefinedTopics] section of the
+// config into the index under their fixed IDs.
+func loadPredefinedTopics(repo *topicNames, topics map[string]string) error {
+	for key, topic := range topics {
+		id, err := strconv.ParseUint(key, 0, 16)
+		if err != nil || id == 0x0000 || id == 0xFFFF {
+			return errors.New("invalid predefined topic ID: " + key)
+		}
+		if _, err := ValidateTopicName(topic); err != nil {
+			return errors.New("invalid predefined topic " + key + ": " + err.Error())
+		}
+		repo.predefine(uint16(id), topic)
+	}
+	return nil
+}
+
+// Short topic names are two characters long and are sent in place of a topic
+// ID without registration.
+func isShortTopic(topic string) bool {
+	return len(topic) == 2
+}
+
+func shortTopic(id uint16) string {
+	return string(encodeUint16(id))
+}
+
+func shortTopicId(topic string) uint16 {
+	return binary.BigEndian.Uint16([]byte(topic))
 }
 
 // Topic Names and Topic Filters
@@ -73,29 +201,62 @@ func (repo *topicNames) putTopic(topic string) uint16 {
 //     Example:  a subscription to "foo/#" will match messages published to "foo".
 
 func ContainsWildcard(topic string) bool {
-	if len(topic) == 1 && (topic == "+" || topic == "#") {
-		return true
-	}
-	if len(topic) > 1 && (topic[len(topic)-2:] == "/#" || topic[len(topic)-2:] == "/+") {
-		return true
+	for _, level := range strings.Split(topic, "/") {
+		if level == "+" || level == "#" {
+			return true
+		}
 	}
-	return strings.Contains(topic, "/+/")
+	return false
 }
 
 func ValidateTopicFilter(topic string) ([]string, error) {
 	if len(topic) == 0 {
 		return nil, errors.New("TopicFilter cannot be empty string")
 	}
+	if group, filter, shared := sharedFilter(topic); shared {
+		if group == "" || strings.ContainsAny(group, "+#") || filter == "" {
+			return nil, errors.New("TopicFilter of a shared subscription is invalid")
+		}
+		topic = filter
+	}
 
 	levels := strings.Split(topic, "/")
 	for i, level := range levels {
 		if level == "#" && i != len(levels)-1 {
 			return nil, errors.New("TopicFilter contains invalid wildcard")
 		}
+		if level != "#" && level != "+" && strings.ContainsAny(level, "#+") {
+			return nil, errors.New("TopicFilter wildcard must occupy an entire level")
+		}
 	}
 	return levels, nil
 }
 
+// MatchTopic reports whether a topic name matches a topic filter.
+func MatchTopic(filter, topic string) bool {
+	if filter == topic {
+		return true
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	// Wildcards do not match topics beginning with '$' at the first level.
+	if len(topic) > 0 && topic[0] == '$' && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
 func ValidateTopicName(topic string) ([]string, error) {
 	if len(topic) == 0 {
 		return nil, errors.New("TopicName cannot be empty string")
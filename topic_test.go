@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+const benchTopics = 100000
+
+// A single index cannot hold more topics than there are 16-bit topic IDs.
+const benchRegisteredTopics = 65000
+
+func benchTopicName(i int) string {
+	return "/sensors/" + strconv.Itoa(i%100) + "/" + strconv.Itoa(i)
+}
+
+func newTopicIndex() *topicNames {
+	return &topicNames{
+		contents:   make(map[uint16]string),
+		ids:        make(map[string]uint16),
+		predefined: make(map[uint16]bool),
+		recent:     make(map[uint16]bool),
+	}
+}
+
+func newBenchIndex() *topicNames {
+	repo := newTopicIndex()
+	for i := 0; i < benchRegisteredTopics; i++ {
+		repo.putTopic(benchTopicName(i))
+	}
+	return repo
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"/a/b", "/a/b", true},
+		{"/a/b", "/a/c", false},
+		{"/a/+", "/a/b", true},
+		{"/a/+", "/a/b/c", false},
+		{"/a/#", "/a/b/c", true},
+		{"/a/#", "/a", true},
+		{"/a/#", "/b", false},
+		{"+/+", "/a", true},
+		{"#", "/a/b", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"$SYS/+", "$SYS/uptime", true},
+		{"$SYS/uptime", "$SYS/uptime", true},
+		{"/$a/+", "/$a/b", true},
+	}
+	for _, test := range tests {
+		if MatchTopic(test.filter, test.topic) != test.match {
+			t.Errorf("MatchTopic(%q, %q) != %v", test.filter, test.topic, test.match)
+		}
+	}
+}
+
+func TestReclaimRecentTopics(t *testing.T) {
+	repo := newTopicIndex()
+	repo.predefine(1, "/predefined")
+	for i := 2; i < 0xFFFF; i++ {
+		if repo.putTopic(benchTopicName(i)) == 0 {
+			t.Fatal("topic ID space full after", i, "topics")
+		}
+	}
+	// Every topic was handed out since the last reclaim, but none of them
+	// is used by a client.
+	id := repo.putTopic("/reclaim/new")
+	if id == 0 {
+		t.Fatal("no topic ID reclaimed")
+	}
+	if repo.getTopic(id) != "/reclaim/new" || repo.getTopic(1) != "/predefined" {
+		t.Fatal("wrong topics after reclaim")
+	}
+}
+
+// BenchmarkRegister looks up the IDs of topics the way REGISTER does, with
+// the index close to full.
+func BenchmarkRegister(b *testing.B) {
+	repo := newBenchIndex()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		repo.putTopic(benchTopicName(i % benchRegisteredTopics))
+	}
+}
+
+// BenchmarkRegisterNew registers topics not known before, filling indexes up
+// to close to full.
+func BenchmarkRegisterNew(b *testing.B) {
+	var repo *topicNames
+	for i := 0; i < b.N; i++ {
+		if i%benchRegisteredTopics == 0 {
+			b.StopTimer()
+			repo = newTopicIndex()
+			b.StartTimer()
+		}
+		if repo.putTopic(benchTopicName(i)) == 0 {
+			b.Fatal("no topic ID left")
+		}
+	}
+}
@@ -5,13 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"sync"
 	"time"
 )
 
-var tIndex topicNames
-var clients Clients
-
 func validateClientId(clientid []byte) (string, error) {
 	if len(clientid) == 0 {
 		return "", errors.New("zero-length client id not allowed")
@@ -23,16 +19,6 @@ func validateClientId(clientid []byte) (string, error) {
 }
 
 func ListenUDP(addr string) {
-	tIndex = topicNames{
-		sync.RWMutex{},
-		make(map[uint16]string),
-		0,
-	}
-	clients = Clients{
-		sync.RWMutex{},
-		make(map[string]*Client),
-	}
-
 	address, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		log.Fatalln(err)
@@ -42,6 +28,11 @@ func ListenUDP(addr string) {
 		log.Fatalln(err)
 	}
 	go Advertise(180)
+	ServeUDP(udpconn)
+}
+
+// ServeUDP handles MQTT-SN packets arriving on the socket.
+func ServeUDP(udpconn *net.UDPConn) {
 	for {
 		buf := make([]byte, serv.Config.Buffer)
 		n, remote, err := udpconn.ReadFromUDP(buf)
@@ -65,7 +56,10 @@ func ListenUDP(addr string) {
 // Advertise sends packet nearly every `d` seconds
 func Advertise(d uint16) {
 	for {
-		for _, client := range clients.clients {
+		for _, client := range clients.List() {
+			if client.Stream() != nil {
+				continue
+			}
 			adv := NewMessage(ADVERTISE).(*AdvertiseMessage)
 			adv.GatewayId = 0
 			adv.Duration = d
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// delayedWill is a will waiting for the Will Delay Interval of its MQTT 5.0
+// client to pass.
+type delayedWill struct {
+	will  *Will
+	timer *time.Timer
+}
+
+// pendingWills keeps delayed wills by client id. A will is dropped if its
+// client resumes the session in time, and published early if the session
+// ends first.
+type pendingWills struct {
+	sync.Mutex
+	wills map[string]*delayedWill
+}
+
+// publishWill publishes the will of a lost client, if there is any, once the
+// Will Delay Interval or the session of the client ends.
+func publishWill(c *Client) {
+	will := c.Will()
+	if will == nil {
+		return
+	}
+	var delay time.Duration
+	if will.Properties != nil && !c.CleanSession() {
+		delay = time.Duration(will.Properties.WillDelay) * time.Second
+		if expiry := c.SessionExpiry(); expiry != 0 && expiry < delay {
+			delay = expiry
+		}
+	}
+	if delay == 0 {
+		sendWill(will)
+		return
+	}
+	wills.delay(c.ClientId, will, delay)
+}
+
+func sendWill(will *Will) {
+	p := NewPublishMessage(0, 0x00, will.Msg, will.Qos, 0, will.Retain, false)
+	p.Properties = newMessageProperties(will.Properties, "")
+	publish(will.Topic, p)
+}
+
+func (w *pendingWills) delay(clientId string, will *Will, d time.Duration) {
+	defer w.Unlock()
+	w.Lock()
+	if old, ok := w.wills[clientId]; ok {
+		old.timer.Stop()
+	}
+	dw := &delayedWill{will: will}
+	dw.timer = time.AfterFunc(d, func() {
+		w.Lock()
+		current := w.wills[clientId] == dw
+		if current {
+			delete(w.wills, clientId)
+		}
+		w.Unlock()
+		if current {
+			sendWill(will)
+		}
+	})
+	w.wills[clientId] = dw
+}
+
+// take removes the delayed will of a client and returns it, or nil if there
+// is none.
+func (w *pendingWills) take(clientId string) *Will {
+	defer w.Unlock()
+	w.Lock()
+	dw, ok := w.wills[clientId]
+	if !ok {
+		return nil
+	}
+	dw.timer.Stop()
+	delete(w.wills, clientId)
+	return dw.will
+}
+
+// Resume drops the delayed will of a client that connected again, or
+// publishes it right away if the client starts a new session.
+func (w *pendingWills) Resume(clientId string, sessionPresent bool) {
+	if will := w.take(clientId); will != nil && !sessionPresent {
+		sendWill(will)
+	}
+}
+
+// End publishes the delayed will of a client whose session ended.
+func (w *pendingWills) End(clientId string) {
+	if will := w.take(clientId); will != nil {
+		sendWill(will)
+	}
+}
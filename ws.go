@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// WebSocket close status codes
+const (
+	wsNormalClosure   = 1000
+	wsProtocolError   = 1002
+	wsUnsupportedData = 1003
+)
+
+// wsDefaultPath is where MQTT is served if WSPath is not configured.
+const wsDefaultPath = "/mqtt"
+
+func ListenWS(addr string, path string) {
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Fatalln(newWSServer(path).Serve(listener))
+}
+
+// newWSServer returns the HTTP server upgrading requests for path. Clients
+// get as long to send the upgrade request as to send CONNECT, and idle
+// connections are dropped as soon; neither applies after the upgrade.
+func newWSServer(path string) *http.Server {
+	if path == "" {
+		path = wsDefaultPath
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, ServeWS)
+	return &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: mqttConnectTimeout,
+		IdleTimeout:       mqttConnectTimeout,
+	}
+}
+
+// ServeWS upgrades an HTTP request to a WebSocket connection with the mqtt
+// subprotocol and runs an MQTT session over it.
+func ServeWS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade expected", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	if !headerContains(r.Header, "Sec-WebSocket-Protocol", "mqtt") {
+		http.Error(w, "The mqtt subprotocol is required", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Println("Unable to take over connection from", r.RemoteAddr, ":", err)
+		return
+	}
+	// The server has no deadlines of its own on hijacked connections.
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n" +
+		"Sec-WebSocket-Protocol: mqtt\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		log.Println("Unable to upgrade connection from", r.RemoteAddr, ":", err)
+		conn.Close()
+		return
+	}
+	ServeMQTT(&wsConn{Conn: conn, r: rw.Reader})
+}
+
+// headerContains reports whether a comma-separated header has the token,
+// ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn turns a WebSocket connection into the byte stream MQTT expects.
+// MQTT packets may be split across binary frames or share one, so frame
+// boundaries are ignored. Every Write is sent as one binary frame.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+	// payload left in the current data frame, and its masking key
+	remaining uint64
+	mask      [4]byte
+	offset    int
+	// set while a fragmented message waits for continuation frames
+	fragmented bool
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+// wsAddr is the address of a WebSocket client, reported as network "ws".
+type wsAddr struct {
+	net.Addr
+}
+
+func (wsAddr) Network() string {
+	return "ws"
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return wsAddr{c.Conn.RemoteAddr()}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	for i := 0; i < n; i++ {
+		b[i] ^= c.mask[c.offset%4]
+		c.offset++
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until the start of a data frame, answering
+// control frames on the way.
+func (c *wsConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		return c.fail(wsProtocolError, "reserved WebSocket frame bits set")
+	}
+	if header[1]&0x80 == 0 {
+		return c.fail(wsProtocolError, "unmasked WebSocket frame")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+		return err
+	}
+	c.offset = 0
+
+	if opcode >= wsClose {
+		// Control frames are short and may come between fragments.
+		if !fin || length > 125 {
+			return c.fail(wsProtocolError, "bad WebSocket control frame")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= c.mask[i%4]
+		}
+		switch opcode {
+		case wsClose:
+			// Echo the status code to complete the closing handshake.
+			if len(payload) >= 2 {
+				payload = payload[:2]
+			}
+			c.close(payload)
+			return io.EOF
+		case wsPing:
+			return c.writeFrame(wsPong, payload)
+		case wsPong:
+			return nil
+		}
+		return c.fail(wsProtocolError, "unknown WebSocket opcode")
+	}
+
+	switch opcode {
+	case wsBinary:
+		if c.fragmented {
+			return c.fail(wsProtocolError, "WebSocket message interrupted")
+		}
+	case wsContinuation:
+		if !c.fragmented {
+			return c.fail(wsProtocolError, "unexpected WebSocket continuation frame")
+		}
+	case wsText:
+		return c.fail(wsUnsupportedData, "MQTT must be sent in binary WebSocket frames")
+	default:
+		return c.fail(wsProtocolError, "unknown WebSocket opcode")
+	}
+	c.fragmented = !fin
+	c.remaining = length
+	return nil
+}
+
+// Write sends b as one binary frame.
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = append(header, encodeUint16(uint16(n))...)
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	defer c.writeLock.Unlock()
+	c.writeLock.Lock()
+	_, err := c.Conn.Write(append(header, payload...))
+	return err
+}
+
+// fail closes the connection with a status code after a protocol violation.
+func (c *wsConn) fail(status uint16, msg string) error {
+	c.close(encodeUint16(status))
+	return errors.New(msg)
+}
+
+// close sends a close frame with the payload, unless one was sent already,
+// and closes the connection.
+func (c *wsConn) close(payload []byte) {
+	c.closeOnce.Do(func() {
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(wsClose, payload)
+		c.Conn.Close()
+	})
+}
+
+// Close closes the connection gracefully with a close frame.
+func (c *wsConn) Close() error {
+	c.close(encodeUint16(wsNormalClosure))
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// wsFrame is a WebSocket frame as seen by the client.
+type wsFrame struct {
+	opcode  byte
+	payload []byte
+}
+
+// wsPeer is the client end of a WebSocket connection. Frames sent by the
+// broker are read as they come.
+type wsPeer struct {
+	t      *testing.T
+	conn   net.Conn
+	frames chan wsFrame
+}
+
+// newWSPipe returns a wsConn as ServeWS makes it after the upgrade, and the
+// client talking to it.
+func newWSPipe(t *testing.T) (*wsConn, *wsPeer) {
+	client, server := net.Pipe()
+	peer := &wsPeer{t, client, make(chan wsFrame, 10)}
+	go func() {
+		defer close(peer.frames)
+		r := bufio.NewReader(client)
+		for {
+			var header [2]byte
+			if _, err := io.ReadFull(r, header[:]); err != nil {
+				return
+			}
+			length := uint64(header[1] & 0x7F)
+			switch length {
+			case 126:
+				var ext [2]byte
+				io.ReadFull(r, ext[:])
+				length = uint64(binary.BigEndian.Uint16(ext[:]))
+			case 127:
+				var ext [8]byte
+				io.ReadFull(r, ext[:])
+				length = binary.BigEndian.Uint64(ext[:])
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			peer.frames <- wsFrame{header[0] & 0x0F, payload}
+		}
+	}()
+	return &wsConn{Conn: server, r: bufio.NewReader(server)}, peer
+}
+
+// frame encodes a client frame, masked unless told otherwise.
+func frame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	var buf bytes.Buffer
+	if fin {
+		opcode |= 0x80
+	}
+	buf.WriteByte(opcode)
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		buf.WriteByte(maskBit | byte(n))
+	default:
+		buf.WriteByte(maskBit | 126)
+		buf.Write(encodeUint16(uint16(n)))
+	}
+	if !masked {
+		buf.Write(payload)
+		return buf.Bytes()
+	}
+	mask := []byte{0x11, 0x22, 0x33, 0x44}
+	buf.Write(mask)
+	for i, b := range payload {
+		buf.WriteByte(b ^ mask[i%4])
+	}
+	return buf.Bytes()
+}
+
+// send writes frames in the background, as the pipe blocks until the broker
+// reads them.
+func (p *wsPeer) send(frames ...[]byte) {
+	go p.conn.Write(bytes.Join(frames, nil))
+}
+
+func (p *wsPeer) recv() wsFrame {
+	p.t.Helper()
+	select {
+	case f, ok := <-p.frames:
+		if !ok {
+			p.t.Fatal("connection closed")
+		}
+		return f
+	case <-time.After(2 * time.Second):
+		p.t.Fatal("no frame received")
+	}
+	return wsFrame{}
+}
+
+// expectClose checks that the broker sent a close frame with the status and
+// closed the connection.
+func (p *wsPeer) expectClose(status uint16) {
+	p.t.Helper()
+	f := p.recv()
+	if f.opcode != wsClose || !bytes.Equal(f.payload, encodeUint16(status)) {
+		p.t.Fatalf("expected close frame with status %d, got %+v", status, f)
+	}
+	if _, ok := <-p.frames; ok {
+		p.t.Fatal("connection not closed")
+	}
+}
+
+// readPackets reads n MQTT packets from the connection.
+func readPackets(t *testing.T, ws *wsConn, n int) []*mqttPacket {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(ws)
+	var packets []*mqttPacket
+	for i := 0; i < n; i++ {
+		p, err := readMQTTPacket(r, mqttMaxLength+5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+func publishBytes(topic, data string) []byte {
+	var buf bytes.Buffer
+	newMQTTPublish(topic, NewPublishMessage(0, 0x00, []byte(data), 0, 0, false, false), 4).Write(&buf)
+	return buf.Bytes()
+}
+
+func TestWSPacketsInOneFrame(t *testing.T) {
+	ws, peer := newWSPipe(t)
+	defer peer.conn.Close()
+	peer.send(frame(true, wsBinary, join(publishBytes("/a", "1"), []byte{0xC0, 0}, publishBytes("/b", "2")), true))
+	packets := readPackets(t, ws, 3)
+	if packets[0].Type != MQTT_PUBLISH || packets[1].Type != MQTT_PINGREQ || packets[2].Type != MQTT_PUBLISH {
+		t.Fatalf("got %+v", packets)
+	}
+}
+
+func TestWSPacketAcrossFrames(t *testing.T) {
+	ws, peer := newWSPipe(t)
+	defer peer.conn.Close()
+	p := publishBytes("/split", "payload")
+	peer.send(frame(true, wsBinary, p[:3], true), frame(true, wsBinary, p[3:], true))
+	msg, err := parseMQTTPublish(readPackets(t, ws, 1)[0], 4)
+	if err != nil || msg.Topic != "/split" || string(msg.Payload) != "payload" {
+		t.Fatal(msg, err)
+	}
+}
+
+func TestWSFragmentedMessage(t *testing.T) {
+	ws, peer := newWSPipe(t)
+	defer peer.conn.Close()
+	p := publishBytes("/fragments", "payload")
+	peer.send(frame(false, wsBinary, p[:2], true),
+		frame(false, wsContinuation, p[2:6], true),
+		frame(true, wsContinuation, p[6:], true))
+	msg, err := parseMQTTPublish(readPackets(t, ws, 1)[0], 4)
+	if err != nil || msg.Topic != "/fragments" || string(msg.Payload) != "payload" {
+		t.Fatal(msg, err)
+	}
+}
+
+func TestWSPingBetweenFragments(t *testing.T) {
+	ws, peer := newWSPipe(t)
+	defer peer.conn.Close()
+	p := publishBytes("/ping", "payload")
+	peer.send(frame(false, wsBinary, p[:4], true),
+		frame(true, wsPing, []byte("hello"), true),
+		frame(true, wsContinuation, p[4:], true))
+	msg, err := parseMQTTPublish(readPackets(t, ws, 1)[0], 4)
+	if err != nil || msg.Topic != "/ping" || string(msg.Payload) != "payload" {
+		t.Fatal(msg, err)
+	}
+	if f := peer.recv(); f.opcode != wsPong || string(f.payload) != "hello" {
+		t.Fatalf("expected pong, got %+v", f)
+	}
+}
+
+func TestWSWrite(t *testing.T) {
+	ws, peer := newWSPipe(t)
+	defer peer.conn.Close()
+	large := publishBytes("/large", string(bytes.Repeat([]byte{'x'}, 300)))
+	go func() {
+		ws.Write([]byte{0xD0, 0})
+		ws.Write(large)
+	}()
+	if f := peer.recv(); f.opcode != wsBinary || !bytes.Equal(f.payload, []byte{0xD0, 0}) {
+		t.Fatalf("got %+v", f)
+	}
+	if f := peer.recv(); f.opcode != wsBinary || !bytes.Equal(f.payload, large) {
+		t.Fatalf("got %+v", f)
+	}
+}
+
+func TestWSRejectedFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		frame  []byte
+		status uint16
+	}{
+		{"unmasked", frame(true, wsBinary, []byte{0xC0, 0}, false), wsProtocolError},
+		{"text", frame(true, wsText, []byte{0xC0, 0}, true), wsUnsupportedData},
+		{"continuation without start", frame(true, wsContinuation, []byte{0xC0, 0}, true), wsProtocolError},
+		{"fragmented ping", frame(false, wsPing, nil, true), wsProtocolError},
+	}
+	for _, test := range tests {
+		ws, peer := newWSPipe(t)
+		peer.send(test.frame)
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := ws.Read(make([]byte, 10)); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+		peer.expectClose(test.status)
+	}
+}
+
+func TestWSCloseHandshake(t *testing.T) {
+	ws, peer := newWSPipe(t)
+	peer.send(frame(true, wsClose, encodeUint16(wsNormalClosure), true))
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := ws.Read(make([]byte, 10)); err != io.EOF {
+		t.Fatal("expected EOF, got", err)
+	}
+	peer.expectClose(wsNormalClosure)
+
+	// The broker closing the connection starts the handshake.
+	ws, peer = newWSPipe(t)
+	go ws.Close()
+	peer.expectClose(wsNormalClosure)
+}
+
+func TestWSServerTimeouts(t *testing.T) {
+	// Connections that never upgrade must not be kept forever.
+	server := newWSServer("")
+	if server.ReadHeaderTimeout != mqttConnectTimeout || server.IdleTimeout != mqttConnectTimeout {
+		t.Fatal("timeouts not set", server.ReadHeaderTimeout, server.IdleTimeout)
+	}
+	w := httptest.NewRecorder()
+	server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, wsDefaultPath, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatal("default path not served, got", w.Code)
+	}
+}